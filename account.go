@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeExpensesCSV(zw *zip.Writer, name string, expenses []Expenses) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "type", "description", "category_id", "merchant_id", "account_id", "tags", "amount", "amount_minor", "currency", "spent_at", "created_at", "updated_at"})
+	for _, e := range expenses {
+		cw.Write([]string{
+			strconv.FormatUint(uint64(e.ID), 10),
+			e.Type,
+			e.Description,
+			idString(e.CategoryID),
+			idString(e.MerchantID),
+			idString(e.AccountID),
+			tagNames(e.Tags),
+			FormatMinorUnits(e.AmountMinor, e.Currency),
+			strconv.FormatInt(e.AmountMinor, 10),
+			e.Currency,
+			e.SpentAt.Format(time.RFC3339),
+			e.CreatedAt.Format(time.RFC3339),
+			e.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func idString(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+func tagNames(tags []Tag) string {
+	names := make([]string, 0, len(tags))
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, ";")
+}
+
+// ExportMyData returns a zip archive with everything stored about the
+// current user.
+func ExportMyData(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	var expenses []Expenses
+	var apiTokens []APIToken
+	var sessions []Session
+	var identities []UserIdentity
+	var categories []Category
+	var merchants []Merchant
+	var accounts []Account
+	var transfers []Transfer
+	var templates []RecurringTemplate
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Order("id").Preload("Tags").Find(&expenses).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Find(&apiTokens).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("created_at").Find(&sessions).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Find(&identities).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Find(&categories).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Preload("Aliases").Find(&merchants).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Find(&accounts).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id").Find(&transfers).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Order("id").Preload("Tags").Find(&templates).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to export data"})
+		return
+	}
+
+	profile := gin.H{
+		"id":                    user.ID,
+		"email":                 user.Email,
+		"display_name":          user.DisplayName,
+		"currency":              user.Currency,
+		"base_currency":         user.ReportingCurrency(),
+		"timezone":              user.Timezone,
+		"locale":                user.Locale,
+		"week_start":            user.WeekStart,
+		"role":                  user.Role,
+		"created_at":            user.CreatedAt,
+		"email_verified_at":     user.EmailVerifiedAt,
+		"password_changed_at":   user.PasswordChangedAt,
+		"two_factor_enabled":    user.TOTPEnabledAt != nil,
+		"two_factor_enabled_at": user.TOTPEnabledAt,
+	}
+
+	tokens := make([]gin.H, 0, len(apiTokens))
+	for _, t := range apiTokens {
+		tokens = append(tokens, gin.H{
+			"id":           t.ID,
+			"name":         t.Name,
+			"prefix":       t.Prefix,
+			"scopes":       t.ScopeList(),
+			"created_at":   t.CreatedAt,
+			"expires_at":   t.ExpiresAt,
+			"last_used_at": t.LastUsedAt,
+			"revoked_at":   t.RevokedAt,
+		})
+	}
+
+	logins := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		logins = append(logins, gin.H{
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+			"revoked_at":   s.RevokedAt,
+		})
+	}
+
+	linked := make([]gin.H, 0, len(identities))
+	for _, i := range identities {
+		linked = append(linked, gin.H{
+			"issuer":     i.Issuer,
+			"subject":    i.Subject,
+			"created_at": i.CreatedAt,
+		})
+	}
+
+	recurring := make([]gin.H, 0, len(templates))
+	for _, t := range templates {
+		recurring = append(recurring, recurringTemplateJSON(t, user.Location(), nil))
+	}
+
+	filename := fmt.Sprintf("expense-tracker-export-%d-%s.zip", user.ID, time.Now().Format("20060102"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(200)
+
+	zw := zip.NewWriter(c.Writer)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", profile},
+		{"expenses.json", expenses},
+		{"api_tokens.json", tokens},
+		{"sessions.json", logins},
+		{"linked_identities.json", linked},
+		{"categories.json", categories},
+		{"merchants.json", merchants},
+		{"accounts.json", accounts},
+		{"transfers.json", transfers},
+		{"recurring.json", recurring},
+	}
+	for _, f := range files {
+		if err := writeZipJSON(zw, f.name, f.data); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+	if err := writeExpensesCSV(zw, "expenses.csv", expenses); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		c.Error(err)
+	}
+}
+
+// reauthWindow is how recently a single sign-on user must have signed in
+// to delete their account without a password.
+const reauthWindow = 5 * time.Minute
+
+// recentSSOLogin reports whether the user has a linked single sign-on
+// identity and started the current session within reauthWindow.
+func recentSSOLogin(c *gin.Context, userID uint) (bool, error) {
+	var linked int64
+	if err := db.Model(&UserIdentity{}).Where("user_id = ?", userID).Count(&linked).Error; err != nil || linked == 0 {
+		return false, err
+	}
+
+	var session Session
+	err := db.Where("id = ? AND user_id = ?", CurrentClaims(c).SessionID, userID).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(session.CreatedAt) <= reauthWindow, nil
+}
+
+// DeleteMe erases the current user and everything that belongs to them
+// in a single transaction. Users who signed up with single sign-on never
+// learn their password, so a sign-in within the last few minutes stands in
+// for it.
+func DeleteMe(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if req.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			c.JSON(401, gin.H{"message": "Invalid password"})
+			return
+		}
+	} else {
+		recent, err := recentSSOLogin(c, user.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Database error"})
+			return
+		}
+		if !recent {
+			c.JSON(400, gin.H{
+				"error":   "reauthentication_required",
+				"message": "password is required. Accounts created with single sign-on can sign in with it again and retry within 5 minutes, or set a password through /password/forgot",
+			})
+			return
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		owned := []interface{}{
+			&Expenses{},
+			&RecurringTemplate{},
+			&Category{},
+			&Tag{},
+			&MerchantAlias{},
+			&Merchant{},
+			&Transfer{},
+			&Account{},
+			&RefreshToken{},
+			&Session{},
+			&PasswordResetToken{},
+			&APIToken{},
+			&RecoveryCode{},
+			&UserIdentity{},
+		}
+		for _, model := range owned {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete account"})
+		return
+	}
+
+	// Login counters are keyed by email, so drop them as well.
+	attempts.Reset(accountAttemptKey("login", user.Email))
+
+	c.Status(204)
+}
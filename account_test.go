@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeleteMeWithoutPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities int
+		signedIn   time.Duration // how long ago the session started
+		want       int
+	}{
+		{"password account", 0, time.Minute, http.StatusBadRequest},
+		{"recent SSO sign-in", 1, time.Minute, http.StatusNoContent},
+		{"stale SSO sign-in", 1, time.Hour, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := attempts
+			attempts = NewMemoryAttemptStore(defaultAttemptPolicy)
+			t.Cleanup(func() { attempts = previous })
+
+			mock := mockDB(t)
+			expectUser(mock)
+			mock.ExpectQuery("SELECT count\\(\\*\\) FROM `user_identities`").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.identities))
+			if tt.identities > 0 {
+				mock.ExpectQuery("SELECT \\* FROM `sessions`").WithArgs("sid", 1, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "created_at"}).AddRow("sid", 1, time.Now().Add(-tt.signedIn)))
+			}
+			if tt.want == http.StatusNoContent {
+				mock.ExpectBegin()
+				for range 15 {
+					mock.ExpectExec("DELETE FROM").WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			c, w := newTestContext(1, http.MethodDelete, "/me", `{}`)
+			CurrentClaims(c).SessionID = "sid"
+			DeleteMe(c)
+			c.Writer.WriteHeaderNow()
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
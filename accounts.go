@@ -0,0 +1,671 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	AccountCash   = "cash"
+	AccountDebit  = "debit"
+	AccountCredit = "credit"
+)
+
+var validAccountTypes = map[string]bool{
+	AccountCash:   true,
+	AccountDebit:  true,
+	AccountCredit: true,
+}
+
+// Account is where money is paid from: a wallet, a bank card or a credit
+// card. Balances are in the account's currency; a credit card's balance
+// goes negative as it is used.
+type Account struct {
+	ID                  uint      `json:"id" gorm:"primaryKey"`
+	UserID              uint      `json:"-" gorm:"not null;index"`
+	User                *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Name                string    `json:"name" gorm:"size:100;not null"`
+	Type                string    `json:"type" gorm:"size:10;not null"`
+	Currency            string    `json:"currency" gorm:"size:3;not null"`
+	OpeningBalanceMinor int64     `json:"opening_balance_minor" gorm:"not null;default:0"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+func (a Account) MarshalJSON() ([]byte, error) {
+	type account Account
+	return json.Marshal(struct {
+		account
+		OpeningBalance json.Number `json:"opening_balance"`
+	}{account(a), json.Number(FormatMinorUnits(a.OpeningBalanceMinor, a.Currency))})
+}
+
+// Transfer moves money between two of a user's accounts. It isn't
+// spending, so it never shows up in expense lists or reports. ToAmountMinor
+// differs from AmountMinor only when the accounts' currencies do.
+type Transfer struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"-" gorm:"not null;index"`
+	User          *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	FromAccountID uint      `json:"from_account_id" gorm:"not null;index"`
+	FromAccount   *Account  `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	ToAccountID   uint      `json:"to_account_id" gorm:"not null;index"`
+	ToAccount     *Account  `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	AmountMinor   int64     `json:"amount_minor" gorm:"not null"`
+	Currency      string    `json:"currency" gorm:"size:3;not null"`
+	ToAmountMinor int64     `json:"to_amount_minor" gorm:"not null"`
+	ToCurrency    string    `json:"to_currency" gorm:"size:3;not null"`
+	Description   string    `json:"description" gorm:"size:255"`
+	TransferredAt time.Time `json:"transferred_at" gorm:"index;not null"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (t Transfer) MarshalJSON() ([]byte, error) {
+	type transfer Transfer
+	return json.Marshal(struct {
+		transfer
+		Amount   json.Number `json:"amount"`
+		ToAmount json.Number `json:"to_amount"`
+	}{
+		transfer(t),
+		json.Number(FormatMinorUnits(t.AmountMinor, t.Currency)),
+		json.Number(FormatMinorUnits(t.ToAmountMinor, t.ToCurrency)),
+	})
+}
+
+var errAccountNotFound = errors.New("account not found")
+
+func findAccount(userID, id uint) (Account, error) {
+	var account Account
+	err := db.Where("user_id = ?", userID).First(&account, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return account, errAccountNotFound
+	}
+	return account, err
+}
+
+// idFromBody reads an ID sent as a JSON number or string.
+func idFromBody(v interface{}) (uint, bool) {
+	var raw string
+	switch val := v.(type) {
+	case json.Number:
+		raw = string(val)
+	case string:
+		raw = val
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	return uint(id), err == nil
+}
+
+// accountFromBody reads "account_id" from a decoded JSON body. A null
+// value unlinks the account.
+func accountFromBody(body map[string]interface{}, userID uint) (account *Account, present bool, err error) {
+	v, ok := body["account_id"]
+	if !ok {
+		return nil, false, nil
+	}
+	if v == nil {
+		return nil, true, nil
+	}
+
+	id, ok := idFromBody(v)
+	if !ok {
+		return nil, true, errAccountNotFound
+	}
+	found, err := findAccount(userID, id)
+	if err != nil {
+		return nil, true, err
+	}
+	return &found, true, nil
+}
+
+func accountIDOf(account *Account) *uint {
+	if account == nil {
+		return nil
+	}
+	return &account.ID
+}
+
+func ListAccounts(c *gin.Context) {
+	var accounts []Account
+	if err := db.Where("user_id = ?", CurrentClaims(c).UserID).Order("name").Find(&accounts).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, accounts)
+}
+
+func CreateAccount(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	errs := ValidationErrors{}
+
+	name, _ := body["name"].(string)
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		errs.Add("name", "is required and must be at most 100 characters")
+	}
+
+	accountType, _ := body["type"].(string)
+	if !validAccountTypes[accountType] {
+		errs.Add("type", "must be cash, debit or credit")
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	code := user.Currency
+	if v, ok := body["currency"].(string); ok {
+		parsed, err := parseCurrency(v)
+		if err != nil {
+			errs.Add("currency", "must be an ISO 4217 code")
+		}
+		code = parsed
+	}
+
+	// Without a valid currency the balance's decimal places can't be checked.
+	var opening int64
+	if v, ok := body["opening_balance"]; ok && errs["currency"] == nil {
+		raw, _ := amountFromBody(map[string]interface{}{"amount": v})
+		minor, err := ParseMinorUnits(raw, code)
+		if err != nil {
+			errs.Add("opening_balance", "must be a number with at most "+strconv.Itoa(currencyScale(code))+" decimal places")
+		}
+		opening = minor
+	}
+
+	if len(errs) > 0 {
+		respondValidation(c, errs)
+		return
+	}
+
+	account := Account{UserID: userID, Name: name, Type: accountType, Currency: code, OpeningBalanceMinor: opening}
+	if err := db.Create(&account).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create account"})
+		return
+	}
+
+	c.JSON(201, account)
+}
+
+// ownAccount loads the account in :id. Other users' accounts are reported
+// as not found.
+func ownAccount(c *gin.Context) (Account, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid account ID"})
+		return Account{}, false
+	}
+
+	account, err := findAccount(CurrentClaims(c).UserID, uint(id))
+	if errors.Is(err, errAccountNotFound) {
+		c.JSON(404, gin.H{"message": "Account not found"})
+		return account, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return account, false
+	}
+
+	return account, true
+}
+
+// UpdateAccount changes the name, type or opening balance. The currency is
+// fixed once the account exists.
+func UpdateAccount(c *gin.Context) {
+	account, ok := ownAccount(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	errs := ValidationErrors{}
+
+	if v, ok := body["name"]; ok {
+		name, _ := v.(string)
+		name = strings.TrimSpace(name)
+		if name == "" || utf8.RuneCountInString(name) > 100 {
+			errs.Add("name", "is required and must be at most 100 characters")
+		}
+		account.Name = name
+	}
+
+	if v, ok := body["type"]; ok {
+		accountType, _ := v.(string)
+		if !validAccountTypes[accountType] {
+			errs.Add("type", "must be cash, debit or credit")
+		}
+		account.Type = accountType
+	}
+
+	if v, ok := body["currency"].(string); ok {
+		if code, err := parseCurrency(v); err != nil || code != account.Currency {
+			errs.Add("currency", "can't be changed")
+		}
+	}
+
+	if v, ok := body["opening_balance"]; ok {
+		raw, _ := amountFromBody(map[string]interface{}{"amount": v})
+		minor, err := ParseMinorUnits(raw, account.Currency)
+		if err != nil {
+			errs.Add("opening_balance", "must be a number with at most "+strconv.Itoa(currencyScale(account.Currency))+" decimal places")
+		}
+		account.OpeningBalanceMinor = minor
+	}
+
+	if len(errs) > 0 {
+		respondValidation(c, errs)
+		return
+	}
+
+	if err := db.Model(&account).Select("name", "type", "opening_balance_minor").Updates(&account).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to update account"})
+		return
+	}
+
+	c.JSON(200, account)
+}
+
+// DeleteAccount removes an account that no expense or transfer uses.
+func DeleteAccount(c *gin.Context) {
+	account, ok := ownAccount(c)
+	if !ok {
+		return
+	}
+
+	var expenses, transfers, templates int64
+	if err := db.Model(&Expenses{}).Where("account_id = ?", account.ID).Count(&expenses).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if err := db.Model(&Transfer{}).Where("from_account_id = ? OR to_account_id = ?", account.ID, account.ID).Count(&transfers).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if err := db.Model(&RecurringTemplate{}).Where("account_id = ?", account.ID).Count(&templates).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if expenses > 0 || transfers > 0 || templates > 0 {
+		c.JSON(409, gin.H{"message": "Account is still used by expenses, transfers or recurring expenses"})
+		return
+	}
+
+	if err := db.Delete(&account).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete account"})
+		return
+	}
+
+	c.Status(204)
+}
+
+func ListTransfers(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	query := db.Where("user_id = ?", userID)
+	if account := c.Query("account_id"); account != "" {
+		query = query.Where("from_account_id = ? OR to_account_id = ?", account, account)
+	}
+
+	var transfers []Transfer
+	if err := query.Order("transferred_at DESC, id DESC").Find(&transfers).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	loc := user.Location()
+	for i := range transfers {
+		transfers[i].TransferredAt = transfers[i].TransferredAt.In(loc)
+	}
+	c.JSON(200, transfers)
+}
+
+// CreateTransfer moves "amount" from one account to another. Between
+// accounts in different currencies "to_amount", the amount that arrived,
+// is required.
+func CreateTransfer(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	errs := ValidationErrors{}
+
+	var from, to Account
+	fromID, ok := idFromBody(body["from_account_id"])
+	if ok {
+		var err error
+		if from, err = findAccount(userID, fromID); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		errs.Add("from_account_id", "must be one of your accounts")
+	}
+	toID, ok := idFromBody(body["to_account_id"])
+	if ok {
+		var err error
+		if to, err = findAccount(userID, toID); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		errs.Add("to_account_id", "must be one of your accounts")
+	}
+	if from.ID != 0 && from.ID == to.ID {
+		errs.Add("to_account_id", "must differ from from_account_id")
+	}
+	if len(errs) > 0 {
+		respondValidation(c, errs)
+		return
+	}
+
+	raw, found := amountFromBody(body)
+	amount, err := ParseMinorUnits(raw, from.Currency)
+	if !found || err != nil || amount <= 0 {
+		errs.Add("amount", "must be a positive number with at most "+strconv.Itoa(currencyScale(from.Currency))+" decimal places")
+	}
+
+	toAmount := amount
+	if v, ok := body["to_amount"]; ok {
+		raw, _ := amountFromBody(map[string]interface{}{"amount": v})
+		parsed, err := ParseMinorUnits(raw, to.Currency)
+		if err != nil || parsed <= 0 {
+			errs.Add("to_amount", "must be a positive number with at most "+strconv.Itoa(currencyScale(to.Currency))+" decimal places")
+		}
+		toAmount = parsed
+	} else if from.Currency != to.Currency {
+		errs.Add("to_amount", "is required between accounts in different currencies")
+	}
+
+	transferredAt, found, err := dateTimeFromBody(body, "transferred_at", user.Location())
+	if err != nil {
+		errs.Add("transferred_at", "must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+	}
+	if !found {
+		transferredAt = time.Now().In(user.Location())
+	}
+
+	description, _ := body["description"].(string)
+	if utf8.RuneCountInString(description) > 255 {
+		errs.Add("description", "must be at most 255 characters")
+	}
+
+	if len(errs) > 0 {
+		respondValidation(c, errs)
+		return
+	}
+
+	transfer := Transfer{
+		UserID:        userID,
+		FromAccountID: from.ID,
+		ToAccountID:   to.ID,
+		AmountMinor:   amount,
+		Currency:      from.Currency,
+		ToAmountMinor: toAmount,
+		ToCurrency:    to.Currency,
+		Description:   description,
+		TransferredAt: transferredAt,
+	}
+	if err := db.Create(&transfer).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create transfer"})
+		return
+	}
+
+	c.JSON(201, transfer)
+}
+
+func DeleteTransfer(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid transfer ID"})
+		return
+	}
+
+	result := db.Where("user_id = ? AND id = ?", CurrentClaims(c).UserID, id).Delete(&Transfer{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete transfer"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"message": "Transfer not found"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// accountBalances returns how much each of the user's accounts moved
+// before cutoff: income paid in, minus expenses paid from it, plus
+// transfers in, minus transfers out.
+func accountBalances(userID uint, cutoff time.Time) (map[uint]int64, error) {
+	balances := map[uint]int64{}
+
+	var spent []struct {
+		AccountID uint
+		Total     int64
+	}
+	if err := db.Model(&Expenses{}).
+		Select("account_id, SUM(CASE WHEN type = ? THEN -amount_minor ELSE amount_minor END) AS total", TypeIncome).
+		Where("user_id = ? AND account_id IS NOT NULL AND spent_at < ?", userID, cutoff).
+		Group("account_id").Scan(&spent).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range spent {
+		balances[s.AccountID] -= s.Total
+	}
+
+	var out, in []struct {
+		AccountID uint
+		Total     int64
+	}
+	if err := db.Model(&Transfer{}).
+		Select("from_account_id AS account_id, SUM(amount_minor) AS total").
+		Where("user_id = ? AND transferred_at < ?", userID, cutoff).
+		Group("from_account_id").Scan(&out).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&Transfer{}).
+		Select("to_account_id AS account_id, SUM(to_amount_minor) AS total").
+		Where("user_id = ? AND transferred_at < ?", userID, cutoff).
+		Group("to_account_id").Scan(&in).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range out {
+		balances[t.AccountID] -= t.Total
+	}
+	for _, t := range in {
+		balances[t.AccountID] += t.Total
+	}
+
+	return balances, nil
+}
+
+// AccountBalances reports every account's balance at the end of ?as_of=
+// (a date in the user's time zone), or now.
+func AccountBalances(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	loc := user.Location()
+
+	cutoff := time.Now().In(loc)
+	asOf := cutoff.Format("2006-01-02")
+	if v := c.Query("as_of"); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "as_of must be formatted as YYYY-MM-DD"})
+			return
+		}
+		cutoff = day.AddDate(0, 0, 1)
+		asOf = v
+	}
+
+	var accounts []Account
+	if err := db.Where("user_id = ?", userID).Order("name").Find(&accounts).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	movements, err := accountBalances(userID, cutoff)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to compute balances"})
+		return
+	}
+
+	rows := make([]gin.H, 0, len(accounts))
+	for _, a := range accounts {
+		balance := a.OpeningBalanceMinor + movements[a.ID]
+		rows = append(rows, gin.H{
+			"account_id":    a.ID,
+			"name":          a.Name,
+			"type":          a.Type,
+			"currency":      a.Currency,
+			"balance":       json.Number(FormatMinorUnits(balance, a.Currency)),
+			"balance_minor": balance,
+		})
+	}
+
+	c.JSON(200, gin.H{"as_of": asOf, "accounts": rows})
+}
+
+// ledgerEntry is one movement on an account with the balance after it.
+type ledgerEntry struct {
+	Date         time.Time   `json:"date"`
+	Kind         string      `json:"kind"`
+	ID           uint        `json:"id"`
+	Description  string      `json:"description"`
+	Amount       json.Number `json:"amount"`
+	AmountMinor  int64       `json:"amount_minor"`
+	Balance      json.Number `json:"balance"`
+	BalanceMinor int64       `json:"balance_minor"`
+}
+
+// AccountLedger lists an account's expenses and transfers between ?start=
+// and ?end= (inclusive dates) with the running balance after each one.
+func AccountLedger(c *gin.Context) {
+	account, ok := ownAccount(c)
+	if !ok {
+		return
+	}
+
+	var user User
+	if err := db.First(&user, account.UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	loc := user.Location()
+
+	var start, end time.Time
+	if v := c.Query("start"); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Date must be formatted as YYYY-MM-DD"})
+			return
+		}
+		start = day
+	}
+	end = time.Now().In(loc).AddDate(0, 0, 1)
+	if v := c.Query("end"); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Date must be formatted as YYYY-MM-DD"})
+			return
+		}
+		end = day.AddDate(0, 0, 1)
+	}
+
+	movements, err := accountBalances(account.UserID, start)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to compute balances"})
+		return
+	}
+	opening := account.OpeningBalanceMinor + movements[account.ID]
+
+	var expenses []Expenses
+	if err := db.Where("account_id = ? AND spent_at >= ? AND spent_at < ?", account.ID, start, end).Find(&expenses).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	var transfers []Transfer
+	if err := db.Where("(from_account_id = ? OR to_account_id = ?) AND transferred_at >= ? AND transferred_at < ?", account.ID, account.ID, start, end).
+		Find(&transfers).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	entries := make([]ledgerEntry, 0, len(expenses)+len(transfers))
+	for _, e := range expenses {
+		amount := -e.AmountMinor
+		if e.Type == TypeIncome {
+			amount = e.AmountMinor
+		}
+		entries = append(entries, ledgerEntry{Date: e.SpentAt, Kind: e.Type, ID: e.ID, Description: e.Description, AmountMinor: amount})
+	}
+	for _, t := range transfers {
+		entry := ledgerEntry{Date: t.TransferredAt, Kind: TypeTransfer, ID: t.ID, Description: t.Description}
+		if t.FromAccountID == account.ID {
+			entry.AmountMinor = -t.AmountMinor
+		} else {
+			entry.AmountMinor = t.ToAmountMinor
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+
+	balance := opening
+	for i := range entries {
+		balance += entries[i].AmountMinor
+		entries[i].Date = entries[i].Date.In(loc)
+		entries[i].Amount = json.Number(FormatMinorUnits(entries[i].AmountMinor, account.Currency))
+		entries[i].Balance = json.Number(FormatMinorUnits(balance, account.Currency))
+		entries[i].BalanceMinor = balance
+	}
+
+	c.JSON(200, gin.H{
+		"account":                account,
+		"starting_balance":       json.Number(FormatMinorUnits(opening, account.Currency)),
+		"starting_balance_minor": opening,
+		"entries":                entries,
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeleteAccountInUse(t *testing.T) {
+	tests := []struct {
+		name                           string
+		expenses, transfers, templates int
+		want                           int
+	}{
+		{"unused", 0, 0, 0, 204},
+		{"expenses", 2, 0, 0, 409},
+		{"transfers", 0, 1, 0, 409},
+		{"recurring expenses", 0, 0, 1, 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			count := func(n int) *sqlmock.Rows { return sqlmock.NewRows([]string{"count"}).AddRow(n) }
+
+			mock.ExpectQuery("SELECT \\* FROM `accounts`").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "currency"}).AddRow(4, 1, "Visa", "EUR"))
+			mock.ExpectQuery("SELECT count\\(\\*\\) FROM `expenses`").WithArgs(4).WillReturnRows(count(tt.expenses))
+			mock.ExpectQuery("SELECT count\\(\\*\\) FROM `transfers`").WithArgs(4, 4).WillReturnRows(count(tt.transfers))
+			mock.ExpectQuery("SELECT count\\(\\*\\) FROM `recurring_templates`").WithArgs(4).WillReturnRows(count(tt.templates))
+			if tt.want == 204 {
+				mock.ExpectExec("DELETE FROM `accounts`").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			c, w := newTestContext(1, "DELETE", "/accounts/4", "")
+			c.Params = gin.Params{{Key: "id", Value: "4"}}
+			DeleteAccount(c)
+			c.Writer.WriteHeaderNow()
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestCreateAccountCountsCharacters(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+	mock.ExpectExec("INSERT INTO `accounts`").WillReturnResult(sqlmock.NewResult(4, 1))
+
+	c, w := newTestContext(1, "POST", "/accounts", `{"name":"`+strings.Repeat("ä", 100)+`","type":"cash"}`)
+	CreateAccount(c)
+	if w.Code != 201 {
+		t.Fatalf("status %d, want 201: %s", w.Code, w.Body)
+	}
+}
+
+func TestCreateAccountInvalidCurrencySkipsBalance(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+
+	c, w := newTestContext(1, "POST", "/accounts", `{"name":"Cash","type":"cash","currency":"XX","opening_balance":12.345}`)
+	CreateAccount(c)
+
+	var resp struct {
+		Errors map[string][]string `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 || resp.Errors["currency"] == nil || resp.Errors["opening_balance"] != nil {
+		t.Errorf("status %d, errors %v; want only a currency error", w.Code, resp.Errors)
+	}
+}
+
+func TestDeleteTransferRejectsBadID(t *testing.T) {
+	mockDB(t)
+
+	c, w := newTestContext(1, "DELETE", "/transfers/x", "")
+	c.Params = gin.Params{{Key: "id", Value: "x"}}
+	DeleteTransfer(c)
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var ErrAccountDisabled = errors.New("account is disabled")
+
+// Roles returns the roles carried in the user's tokens. Admins are users
+// too, so they keep access to the regular endpoints.
+func (u User) Roles() []string {
+	if u.Role == RoleAdmin {
+		return []string{RoleUser, RoleAdmin}
+	}
+	return []string{RoleUser}
+}
+
+// RequireRole only lets through tokens that carry role, and only while the
+// user still has it: a demoted or disabled admin loses access before their
+// token expires. Personal access tokens carry no roles.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := CurrentClaims(c)
+		if !slices.Contains(claims.Roles, role) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "forbidden", "message": "Requires role " + role})
+			return
+		}
+
+		var user User
+		if err := db.Select("id", "role", "disabled_at").First(&user, claims.UserID).Error; err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"message": "Database error"})
+			return
+		}
+
+		if user.DisabledAt != nil || !slices.Contains(user.Roles(), role) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "forbidden", "message": "Requires role " + role})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// promoteAdmins gives the admin role to every email listed in ADMIN_EMAILS
+// so a fresh install has a way to reach the /admin endpoints.
+func promoteAdmins() {
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = normalizeEmail(email)
+		if email == "" {
+			continue
+		}
+
+		var user User
+		err := db.Where("email = ?", email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			println("⚠️ ADMIN_EMAILS lists", email, "but no account uses it")
+			continue
+		}
+		if err != nil {
+			panic("❌ Failed to look up admin " + email + ": " + err.Error())
+		}
+		if user.Role == RoleAdmin {
+			continue
+		}
+		if err := db.Model(&user).Update("role", RoleAdmin).Error; err != nil {
+			panic("❌ Failed to promote admin " + email + ": " + err.Error())
+		}
+		println("✅ Promoted", email, "to admin")
+	}
+}
+
+func adminUserJSON(u User) gin.H {
+	return gin.H{
+		"id":                u.ID,
+		"email":             u.Email,
+		"role":              u.Role,
+		"email_verified_at": u.EmailVerifiedAt,
+		"disabled_at":       u.DisabledAt,
+		"created_at":        u.CreatedAt,
+	}
+}
+
+func adminTargetUser(c *gin.Context) (*User, bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid user ID"})
+		return nil, false
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"message": "User not found"})
+		} else {
+			c.JSON(500, gin.H{"message": "Database error"})
+		}
+		return nil, false
+	}
+
+	return &user, true
+}
+
+func AdminListUsers(c *gin.Context) {
+	var users []User
+	if err := db.Order("id").Find(&users).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch users"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(users))
+	for _, u := range users {
+		result = append(result, adminUserJSON(u))
+	}
+
+	c.JSON(200, result)
+}
+
+func AdminDisableUser(c *gin.Context) {
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	if user.ID == CurrentClaims(c).UserID {
+		c.JSON(400, gin.H{"message": "You can't disable your own account"})
+		return
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("disabled_at", now).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to disable user"})
+		return
+	}
+
+	c.JSON(200, adminUserJSON(*user))
+}
+
+func AdminEnableUser(c *gin.Context) {
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := db.Model(user).Update("disabled_at", nil).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to enable user"})
+		return
+	}
+
+	c.JSON(200, adminUserJSON(*user))
+}
+
+func AdminSetRole(c *gin.Context) {
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	if req.Role != RoleUser && req.Role != RoleAdmin {
+		c.JSON(400, gin.H{"message": "role must be 'user' or 'admin'"})
+		return
+	}
+	if user.ID == CurrentClaims(c).UserID && req.Role != RoleAdmin {
+		c.JSON(400, gin.H{"message": "You can't remove your own admin role"})
+		return
+	}
+
+	if err := db.Model(user).Update("role", req.Role).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to update role"})
+		return
+	}
+
+	c.JSON(200, adminUserJSON(*user))
+}
+
+func AdminStats(c *gin.Context) {
+	var users, disabled, expenses int64
+	if err := db.Model(&User{}).Count(&users).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch stats"})
+		return
+	}
+	if err := db.Model(&User{}).Where("disabled_at IS NOT NULL").Count(&disabled).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch stats"})
+		return
+	}
+	if err := db.Model(&Expenses{}).Count(&expenses).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch stats"})
+		return
+	}
+
+	var perUser []struct {
+		UserID uint  `json:"user_id"`
+		Count  int64 `json:"count"`
+	}
+	err := db.Model(&Expenses{}).
+		Select("user_id, COUNT(*) AS count").
+		Group("user_id").Order("count DESC").
+		Scan(&perUser).Error
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch stats"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"users":             users,
+		"disabled_users":    disabled,
+		"expenses":          expenses,
+		"expenses_per_user": perUser,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRequireRoleChecksCurrentRole(t *testing.T) {
+	disabled := time.Now()
+	tests := []struct {
+		name       string
+		role       string
+		disabledAt *time.Time
+		want       int
+	}{
+		{"still admin", RoleAdmin, nil, http.StatusOK},
+		{"demoted", RoleUser, nil, http.StatusForbidden},
+		{"disabled", RoleAdmin, &disabled, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery("SELECT `id`,`role`,`disabled_at` FROM `users`").
+				WithArgs(1, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "role", "disabled_at"}).AddRow(1, tt.role, tt.disabledAt))
+
+			c, w := newTestContext(1, http.MethodGet, "/admin/users", "")
+			CurrentClaims(c).Roles = []string{RoleUser, RoleAdmin}
+			RequireRole(RoleAdmin)(c)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRequireRoleRejectsTokenWithoutRole(t *testing.T) {
+	mockDB(t)
+	c, w := newTestContext(1, http.MethodGet, "/admin/users", "")
+	RequireRole(RoleAdmin)(c)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
+
+func TestPromoteAdmins(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "Ann@example.com, nobody@example.com,root@example.com")
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT \\* FROM `users`").WithArgs("ann@example.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role"}).AddRow(1, "ann@example.com", RoleUser))
+	mock.ExpectExec("UPDATE `users` SET `role`").WithArgs(RoleAdmin, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT \\* FROM `users`").WithArgs("nobody@example.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT \\* FROM `users`").WithArgs("root@example.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role"}).AddRow(2, "root@example.com", RoleAdmin))
+
+	promoteAdmins()
+}
+
+func TestPromoteAdminsPanicsOnDatabaseError(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "ann@example.com")
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT \\* FROM `users`").WillReturnError(errors.New("connection refused"))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("promoteAdmins didn't panic")
+		}
+	}()
+	promoteAdmins()
+}
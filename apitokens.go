@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// apiTokenPrefix marks personal access tokens so the auth middleware can
+// tell them apart from JWTs.
+const apiTokenPrefix = "etk_"
+
+const (
+	ScopeExpensesRead  = "expenses:read"
+	ScopeExpensesWrite = "expenses:write"
+	ScopeReportsRead   = "reports:read"
+)
+
+var validScopes = map[string]bool{
+	ScopeExpensesRead:  true,
+	ScopeExpensesWrite: true,
+	ScopeReportsRead:   true,
+}
+
+var (
+	errAPITokenInvalid = errors.New("invalid api token")
+	errAPITokenExpired = errors.New("api token expired")
+)
+
+// APIToken is a long-lived personal access token. Only the SHA-256 hash
+// of the token is stored; Prefix is kept so users can recognise it.
+type APIToken struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"-" gorm:"index;not null"`
+	User       *User      `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"size:16;not null"`
+	TokenHash  string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Scopes     string     `json:"-" gorm:"not null"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (t APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// ValidateAPIToken looks up a personal access token and returns claims
+// limited to its scopes.
+func ValidateAPIToken(plain string) (*Claims, error) {
+	var token APIToken
+	err := db.Where("token_hash = ?", hashToken(plain)).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errAPITokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RevokedAt != nil {
+		return nil, ErrTokenRevoked
+	}
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return nil, errAPITokenExpired
+	}
+
+	var user User
+	if err := db.Select("id", "disabled_at").First(&user, token.UserID).Error; err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	db.Model(&token).UpdateColumn("last_used_at", time.Now())
+
+	return &Claims{
+		UserID:     token.UserID,
+		Scopes:     token.ScopeList(),
+		APITokenID: token.ID,
+	}, nil
+}
+
+func CreateAPIToken(c *gin.Context) {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(400, gin.H{"message": "name is required"})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		c.JSON(400, gin.H{"message": "at least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			c.JSON(400, gin.H{"message": "Unknown scope: " + scope})
+			return
+		}
+	}
+
+	if req.ExpiresInDays < 0 {
+		c.JSON(400, gin.H{"message": "expires_in_days must be positive"})
+		return
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create token"})
+		return
+	}
+	plain := apiTokenPrefix + secret
+
+	token := APIToken{
+		UserID:    CurrentClaims(c).UserID,
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    plain[:len(apiTokenPrefix)+8],
+		TokenHash: hashToken(plain),
+		Scopes:    strings.Join(req.Scopes, " "),
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		token.ExpiresAt = &expires
+	}
+
+	if err := db.Create(&token).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create token"})
+		return
+	}
+
+	// The plain token is only ever shown here.
+	c.JSON(201, gin.H{
+		"id":         token.ID,
+		"name":       token.Name,
+		"token":      plain,
+		"scopes":     token.ScopeList(),
+		"expires_at": token.ExpiresAt,
+	})
+}
+
+func ListAPITokens(c *gin.Context) {
+	var tokens []APIToken
+	err := db.Where("user_id = ? AND revoked_at IS NULL", CurrentClaims(c).UserID).
+		Order("created_at DESC").Find(&tokens).Error
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch tokens"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(tokens))
+	for _, t := range tokens {
+		result = append(result, gin.H{
+			"id":           t.ID,
+			"name":         t.Name,
+			"prefix":       t.Prefix,
+			"scopes":       t.ScopeList(),
+			"expires_at":   t.ExpiresAt,
+			"last_used_at": t.LastUsedAt,
+			"created_at":   t.CreatedAt,
+		})
+	}
+
+	c.JSON(200, result)
+}
+
+func RevokeAPIToken(c *gin.Context) {
+	tokenID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid token ID"})
+		return
+	}
+
+	result := db.Model(&APIToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, CurrentClaims(c).UserID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(500, gin.H{"message": "Failed to revoke token"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"message": "Token not found"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// RequireScope lets JWT sessions through and checks that a personal
+// access token was granted scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := CurrentClaims(c)
+		if claims.APITokenID == 0 {
+			c.Next()
+			return
+		}
+
+		for _, s := range claims.Scopes {
+			if s == scope {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(403, gin.H{"error": "insufficient_scope", "message": "Token is missing scope " + scope})
+	}
+}
+
+// RequireSession rejects personal access tokens, for endpoints that only
+// an interactive login should reach (such as minting new tokens).
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentClaims(c).APITokenID != 0 {
+			c.AbortWithStatusJSON(403, gin.H{"error": "session_required", "message": "This endpoint can't be used with an API token"})
+			return
+		}
+		c.Next()
+	}
+}
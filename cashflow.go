@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Transaction types. Expenses and income are rows in the expenses table;
+// transfers between accounts are Transfer rows.
+const (
+	TypeExpense  = "expense"
+	TypeIncome   = "income"
+	TypeTransfer = "transfer"
+)
+
+var (
+	errInvalidType   = errors.New("type must be expense or income")
+	errTransferType  = errors.New("transfers between accounts are recorded with POST /transfers")
+	errInvalidPeriod = errors.New("period must be day, week, month or year")
+)
+
+// typeFromBody reads "type" from a decoded JSON body.
+func typeFromBody(body map[string]interface{}) (string, bool, error) {
+	v, ok := body["type"]
+	if !ok || v == nil {
+		return "", false, nil
+	}
+
+	s, _ := v.(string)
+	switch s {
+	case TypeExpense, TypeIncome:
+		return s, true, nil
+	case TypeTransfer:
+		return "", true, errTransferType
+	default:
+		return "", true, errInvalidType
+	}
+}
+
+// typeFilter narrows query to ?type=expense (the default), income or all.
+func typeFilter(c *gin.Context, query *gorm.DB) (*gorm.DB, bool) {
+	switch c.DefaultQuery("type", TypeExpense) {
+	case TypeExpense:
+		return query.Where("type = ?", TypeExpense), true
+	case TypeIncome:
+		return query.Where("type = ?", TypeIncome), true
+	case "all":
+		return query, true
+	case TypeTransfer:
+		c.JSON(400, gin.H{"message": "List transfers with GET /transfers"})
+		return nil, false
+	default:
+		c.JSON(400, gin.H{"message": "type must be expense, income or all"})
+		return nil, false
+	}
+}
+
+// periodStart returns the start of the day, week, month or year t falls
+// in, in t's location.
+func periodStart(t time.Time, period string, firstDay time.Weekday) time.Time {
+	switch period {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "week":
+		return startOfWeek(t, firstDay)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+type cashFlowPeriod struct {
+	Start    string                 `json:"start"`
+	Income   map[string]json.Number `json:"income"`
+	Expenses map[string]json.Number `json:"expenses"`
+	Net      map[string]json.Number `json:"net"`
+
+	income, expenses map[string]int64
+}
+
+// CashFlow reports income, expenses and income minus expenses for each
+// ?period= (day, week, month or year; month by default) in the date range.
+// Transfers between accounts are not counted. Sums are per currency, or in
+// the base currency with ?convert=true.
+func CashFlow(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	period := c.DefaultQuery("period", "month")
+	switch period {
+	case "day", "week", "month", "year":
+	default:
+		c.JSON(400, gin.H{"message": errInvalidPeriod.Error()})
+		return
+	}
+
+	query, ok := expenseDateFilter(c, db.Where("user_id = ?", userID), user)
+	if !ok {
+		return
+	}
+
+	var rows []Expenses
+	if err := query.Select("id", "type", "amount_minor", "currency", "spent_at").Find(&rows).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to build report"})
+		return
+	}
+
+	localizeExpenses(rows, user)
+	unconverted := 0
+	if wantsConversion(c) {
+		if err := convertExpenses(rows, user.ReportingCurrency()); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to convert amounts"})
+			return
+		}
+	}
+
+	periods := map[string]*cashFlowPeriod{}
+	for _, e := range rows {
+		minor, code := e.AmountMinor, e.Currency
+		if wantsConversion(c) {
+			if e.Converted == nil {
+				unconverted++
+				continue
+			}
+			minor, code = e.Converted.AmountMinor, e.Converted.Currency
+		}
+
+		key := periodStart(e.SpentAt, period, user.FirstDayOfWeek()).Format("2006-01-02")
+		p := periods[key]
+		if p == nil {
+			p = &cashFlowPeriod{Start: key, income: map[string]int64{}, expenses: map[string]int64{}}
+			periods[key] = p
+		}
+		if e.Type == TypeIncome {
+			p.income[code] += minor
+		} else {
+			p.expenses[code] += minor
+		}
+	}
+
+	out := make([]*cashFlowPeriod, 0, len(periods))
+	totalIncome, totalExpenses := map[string]int64{}, map[string]int64{}
+	for _, p := range periods {
+		net := map[string]int64{}
+		for code, v := range p.income {
+			net[code] += v
+			totalIncome[code] += v
+		}
+		for code, v := range p.expenses {
+			net[code] -= v
+			totalExpenses[code] += v
+		}
+		p.Income = formatTotals(p.income)
+		p.Expenses = formatTotals(p.expenses)
+		p.Net = formatTotals(net)
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+
+	totalNet := map[string]int64{}
+	for code, v := range totalIncome {
+		totalNet[code] += v
+	}
+	for code, v := range totalExpenses {
+		totalNet[code] -= v
+	}
+
+	response := gin.H{
+		"period":  period,
+		"periods": out,
+		"total": gin.H{
+			"income":   formatTotals(totalIncome),
+			"expenses": formatTotals(totalExpenses),
+			"net":      formatTotals(totalNet),
+		},
+	}
+	if wantsConversion(c) {
+		response["currency"] = user.ReportingCurrency()
+		response["unconverted"] = unconverted
+	}
+	c.JSON(200, response)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultCategories are the top-level categories every user starts with.
+var defaultCategories = []string{"Groceries", "Leisure", "Electronics", "Utilities", "Clothing", "Health", "Others"}
+
+// Category groups expenses. Built-in categories have no owner and can't be
+// changed; users add their own, optionally below any category they can see.
+type Category struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    *uint     `json:"user_id,omitempty" gorm:"index"`
+	User      *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	ParentID  *uint     `json:"parent_id" gorm:"index"`
+	Parent    *Category `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Name      string    `json:"name" gorm:"size:100;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (cat Category) BuiltIn() bool {
+	return cat.UserID == nil
+}
+
+var errCategoryNotFound = errors.New("category not found")
+
+// seedCategories creates the built-in categories that don't exist yet.
+func seedCategories() {
+	for _, name := range defaultCategories {
+		cat := Category{Name: name}
+		if err := db.Where("user_id IS NULL AND parent_id IS NULL AND name = ?", name).FirstOrCreate(&cat).Error; err != nil {
+			panic("❌ Failed to seed categories: " + err.Error())
+		}
+	}
+}
+
+// visibleCategories returns the built-in categories plus the user's own.
+func visibleCategories(tx *gorm.DB, userID uint) ([]Category, error) {
+	var cats []Category
+	err := tx.Where("user_id IS NULL OR user_id = ?", userID).Order("parent_id, name").Find(&cats).Error
+	return cats, err
+}
+
+// findCategory returns the category with id if userID can see it.
+func findCategory(tx *gorm.DB, userID, id uint) (Category, error) {
+	var cat Category
+	err := tx.Where("user_id IS NULL OR user_id = ?", userID).First(&cat, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return cat, errCategoryNotFound
+	}
+	return cat, err
+}
+
+// withDescendants returns ids together with the IDs of every category
+// below them.
+func withDescendants(cats []Category, ids ...uint) []uint {
+	children := map[uint][]uint{}
+	for _, cat := range cats {
+		if cat.ParentID != nil {
+			children[*cat.ParentID] = append(children[*cat.ParentID], cat.ID)
+		}
+	}
+
+	seen := map[uint]bool{}
+	var out []uint
+	for len(ids) > 0 {
+		id := ids[0]
+		ids = ids[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+		ids = append(ids, children[id]...)
+	}
+	return out
+}
+
+// resolveCategoryFilter turns ?category= (an ID or a name) into the IDs
+// to filter on, subcategories included.
+func resolveCategoryFilter(userID uint, value string) ([]uint, error) {
+	cats, err := visibleCategories(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []uint
+	if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+		for _, cat := range cats {
+			if cat.ID == uint(id) {
+				matches = append(matches, cat.ID)
+			}
+		}
+	} else {
+		for _, cat := range cats {
+			if strings.EqualFold(cat.Name, strings.TrimSpace(value)) {
+				matches = append(matches, cat.ID)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, errCategoryNotFound
+	}
+
+	return withDescendants(cats, matches...), nil
+}
+
+// categoryFromBody reads "category_id" from a decoded JSON body. A null
+// value clears the category.
+func categoryFromBody(body map[string]interface{}, userID uint) (id *uint, present bool, err error) {
+	v, ok := body["category_id"]
+	if !ok {
+		return nil, false, nil
+	}
+	if v == nil {
+		return nil, true, nil
+	}
+
+	var raw string
+	switch val := v.(type) {
+	case json.Number:
+		raw = string(val)
+	case string:
+		raw = val
+	default:
+		return nil, true, errCategoryNotFound
+	}
+	parsed, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, true, errCategoryNotFound
+	}
+
+	cat, err := findCategory(db, userID, uint(parsed))
+	if err != nil {
+		return nil, true, err
+	}
+	return &cat.ID, true, nil
+}
+
+func ListCategories(c *gin.Context) {
+	cats, err := visibleCategories(db, CurrentClaims(c).UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, cats)
+}
+
+type categoryRequest struct {
+	Name     *string `json:"name"`
+	ParentID *uint   `json:"parent_id"`
+}
+
+// checkCategoryName rejects empty names and names already used by a
+// sibling.
+func checkCategoryName(userID uint, parentID *uint, name string, exceptID uint) (string, int, string) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		return "", 400, "name is required and must be at most 100 characters"
+	}
+
+	query := db.Model(&Category{}).Where("(user_id IS NULL OR user_id = ?) AND name = ? AND id <> ?", userID, name, exceptID)
+	if parentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *parentID)
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return "", 500, "Database error"
+	}
+	if count > 0 {
+		return "", 409, "A category with this name already exists here"
+	}
+
+	return name, 0, ""
+}
+
+func CreateCategory(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var req categoryRequest
+	if err := c.BindJSON(&req); err != nil || req.Name == nil {
+		c.JSON(400, gin.H{"message": "name is required"})
+		return
+	}
+
+	if req.ParentID != nil {
+		if _, err := findCategory(db, userID, *req.ParentID); err != nil {
+			c.JSON(400, gin.H{"message": "parent_id must be a category you can see"})
+			return
+		}
+	}
+
+	name, status, msg := checkCategoryName(userID, req.ParentID, *req.Name, 0)
+	if status != 0 {
+		c.JSON(status, gin.H{"message": msg})
+		return
+	}
+
+	cat := Category{UserID: &userID, ParentID: req.ParentID, Name: name}
+	if err := db.Create(&cat).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create category"})
+		return
+	}
+
+	c.JSON(201, cat)
+}
+
+// ownCategory loads the category in :id for changes. Built-in categories
+// are read-only.
+func ownCategory(c *gin.Context) (Category, bool) {
+	userID := CurrentClaims(c).UserID
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid category ID"})
+		return Category{}, false
+	}
+
+	cat, err := findCategory(db, userID, uint(id))
+	if errors.Is(err, errCategoryNotFound) {
+		c.JSON(404, gin.H{"message": "Category not found"})
+		return cat, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return cat, false
+	}
+	if cat.BuiltIn() {
+		c.JSON(403, gin.H{"message": "Built-in categories can't be changed"})
+		return cat, false
+	}
+
+	return cat, true
+}
+
+// UpdateCategory renames a category or moves it. Send "parent_id": null
+// to make it top-level.
+func UpdateCategory(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	cat, ok := ownCategory(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	name := cat.Name
+	if raw, ok := body["name"]; ok {
+		if err := json.Unmarshal(raw, &name); err != nil {
+			c.JSON(400, gin.H{"message": "name must be a string"})
+			return
+		}
+	}
+
+	parentID := cat.ParentID
+	if raw, ok := body["parent_id"]; ok {
+		parentID = nil
+		if err := json.Unmarshal(raw, &parentID); err != nil {
+			c.JSON(400, gin.H{"message": "parent_id must be a category ID or null"})
+			return
+		}
+	}
+	if parentID != nil {
+		cats, err := visibleCategories(db, userID)
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Database error"})
+			return
+		}
+		if _, err := findCategory(db, userID, *parentID); err != nil {
+			c.JSON(400, gin.H{"message": "parent_id must be a category you can see"})
+			return
+		}
+		for _, id := range withDescendants(cats, cat.ID) {
+			if id == *parentID {
+				c.JSON(400, gin.H{"message": "A category can't be moved below itself"})
+				return
+			}
+		}
+	}
+
+	name, status, msg := checkCategoryName(userID, parentID, name, cat.ID)
+	if status != 0 {
+		c.JSON(status, gin.H{"message": msg})
+		return
+	}
+
+	cat.Name = name
+	cat.ParentID = parentID
+	if err := db.Model(&cat).Select("name", "parent_id").Updates(&cat).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to update category"})
+		return
+	}
+
+	c.JSON(200, cat)
+}
+
+// DeleteCategory removes a category. Its subcategories and expenses move
+// up to its parent.
+func DeleteCategory(c *gin.Context) {
+	cat, ok := ownCategory(c)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Category{}).Where("parent_id = ?", cat.ID).Update("parent_id", cat.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Expenses{}).Where("category_id = ?", cat.ID).Update("category_id", cat.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&cat).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete category"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// categoryTotal is one node of the category report.
+type categoryTotal struct {
+	ID       uint                   `json:"id"`
+	Name     string                 `json:"name"`
+	ParentID *uint                  `json:"parent_id"`
+	Own      map[string]json.Number `json:"own"`
+	Total    map[string]json.Number `json:"total"`
+	Children []*categoryTotal       `json:"children"`
+
+	own, total map[string]int64
+}
+
+// CategoryReport returns spending per category as a tree. "own" counts
+// expenses filed directly under a category and "total" adds everything
+// below it. Amounts are summed per currency.
+func CategoryReport(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	query, ok := expenseDateFilter(c, db.Model(&Expenses{}).Where("user_id = ?", userID), user)
+	if !ok {
+		return
+	}
+	query, ok = typeFilter(c, query)
+	if !ok {
+		return
+	}
+
+	var sums []struct {
+		CategoryID *uint
+		Currency   string
+		Total      int64
+	}
+	if err := query.Select("category_id, currency, SUM(amount_minor) AS total").
+		Group("category_id, currency").Scan(&sums).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to build report"})
+		return
+	}
+
+	cats, err := visibleCategories(db, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	nodes := map[uint]*categoryTotal{}
+	for _, cat := range cats {
+		nodes[cat.ID] = &categoryTotal{
+			ID:       cat.ID,
+			Name:     cat.Name,
+			ParentID: cat.ParentID,
+			Children: []*categoryTotal{},
+			own:      map[string]int64{},
+			total:    map[string]int64{},
+		}
+	}
+
+	uncategorized := map[string]int64{}
+	for _, s := range sums {
+		if s.CategoryID == nil || nodes[*s.CategoryID] == nil {
+			uncategorized[s.Currency] += s.Total
+			continue
+		}
+		nodes[*s.CategoryID].own[s.Currency] += s.Total
+	}
+
+	var roots []*categoryTotal
+	for _, cat := range cats {
+		node := nodes[cat.ID]
+		if cat.ParentID != nil && nodes[*cat.ParentID] != nil {
+			parent := nodes[*cat.ParentID]
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var rollUp func(n *categoryTotal)
+	rollUp = func(n *categoryTotal) {
+		for code, v := range n.own {
+			n.total[code] += v
+		}
+		for _, child := range n.Children {
+			rollUp(child)
+			for code, v := range child.total {
+				n.total[code] += v
+			}
+		}
+		n.Own = formatTotals(n.own)
+		n.Total = formatTotals(n.total)
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	}
+	for _, root := range roots {
+		rollUp(root)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+
+	c.JSON(200, gin.H{
+		"categories":    roots,
+		"uncategorized": formatTotals(uncategorized),
+	})
+}
+
+// formatTotals renders minor-unit sums per currency as JSON numbers.
+func formatTotals(totals map[string]int64) map[string]json.Number {
+	out := make(map[string]json.Number, len(totals))
+	for code, minor := range totals {
+		out[code] = json.Number(FormatMinorUnits(minor, code))
+	}
+	return out
+}
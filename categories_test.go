@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWithDescendants(t *testing.T) {
+	parent := func(id uint) *uint { return &id }
+	// 1 has children 2 and 3, and 2 has child 4. 5 has child 6. 7 and 8
+	// are each other's parent, which the API never allows, but such rows
+	// must not make the lookup loop.
+	cats := []Category{
+		{ID: 1},
+		{ID: 2, ParentID: parent(1)},
+		{ID: 3, ParentID: parent(1)},
+		{ID: 4, ParentID: parent(2)},
+		{ID: 5},
+		{ID: 6, ParentID: parent(5)},
+		{ID: 7, ParentID: parent(8)},
+		{ID: 8, ParentID: parent(7)},
+	}
+
+	tests := []struct {
+		name string
+		ids  []uint
+		want []uint
+	}{
+		{"leaf", []uint{4}, []uint{4}},
+		{"subtree", []uint{2}, []uint{2, 4}},
+		{"root", []uint{1}, []uint{1, 2, 3, 4}},
+		{"several roots", []uint{1, 5}, []uint{1, 2, 3, 4, 5, 6}},
+		{"overlapping ids", []uint{1, 2, 4}, []uint{1, 2, 3, 4}},
+		{"cycle", []uint{7}, []uint{7, 8}},
+		{"unknown id", []uint{99}, []uint{99}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withDescendants(cats, tt.ids...)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("withDescendants(%v) = %v, want %v", tt.ids, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCategoryNameCountsCharacters(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM `categories`").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	if _, status, msg := checkCategoryName(1, nil, strings.Repeat("ü", 100), 0); status != 0 {
+		t.Errorf("100 characters: %d %s", status, msg)
+	}
+	if _, status, _ := checkCategoryName(1, nil, strings.Repeat("ü", 101), 0); status != 400 {
+		t.Errorf("101 characters: status %d, want 400", status)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ExchangeRate says that one unit of Base was worth Rate units of Quote on
+// Date. A rate is used from its date until a newer one is loaded.
+type ExchangeRate struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	Base      string    `json:"base" gorm:"size:3;not null;uniqueIndex:idx_exchange_rate"`
+	Quote     string    `json:"quote" gorm:"size:3;not null;uniqueIndex:idx_exchange_rate"`
+	Date      time.Time `json:"date" gorm:"type:date;not null;uniqueIndex:idx_exchange_rate"`
+	Rate      string    `json:"rate" gorm:"type:decimal(24,12);not null"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	errNoExchangeRate     = errors.New("no exchange rate")
+	errConversionOverflow = errors.New("converted amount out of range")
+)
+
+// ConvertedAmount is an expense amount in the user's base currency.
+type ConvertedAmount struct {
+	Amount      json.Number `json:"amount"`
+	AmountMinor int64       `json:"amount_minor"`
+	Currency    string      `json:"currency"`
+	Rate        string      `json:"rate"`
+	RateDate    time.Time   `json:"rate_date"`
+}
+
+type exchangeRateInput struct {
+	Date  string      `json:"date"`
+	Base  string      `json:"base"`
+	Quote string      `json:"quote"`
+	Rate  json.Number `json:"rate"`
+}
+
+// parse validates the input and returns the row to store.
+func (in exchangeRateInput) parse() (ExchangeRate, error) {
+	// The DSN uses loc=Local, so the date is parsed in the same location
+	// to be stored as the day that was given rather than a day earlier.
+	date, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(in.Date), time.Local)
+	if err != nil {
+		return ExchangeRate{}, errors.New("date must be formatted as YYYY-MM-DD")
+	}
+	base, err := parseCurrency(in.Base)
+	if err != nil {
+		return ExchangeRate{}, errors.New("base must be an ISO 4217 code")
+	}
+	quote, err := parseCurrency(in.Quote)
+	if err != nil {
+		return ExchangeRate{}, errors.New("quote must be an ISO 4217 code")
+	}
+	if base == quote {
+		return ExchangeRate{}, errors.New("base and quote must differ")
+	}
+	rate, ok := parseDecimal(string(in.Rate))
+	if !ok || rate.Sign() <= 0 {
+		return ExchangeRate{}, errors.New("rate must be a positive number")
+	}
+
+	return ExchangeRate{Base: base, Quote: quote, Date: date, Rate: rate.FloatString(12)}, nil
+}
+
+// saveExchangeRates inserts rates, replacing any already stored for the
+// same pair and date.
+func saveExchangeRates(tx *gorm.DB, rates []ExchangeRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "base"}, {Name: "quote"}, {Name: "date"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "updated_at"}),
+	}).Create(&rates).Error
+}
+
+// readExchangeRatesCSV reads "date,base,quote,rate" lines. A header line
+// is skipped.
+func readExchangeRatesCSV(r io.Reader) ([]ExchangeRate, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	var rates []ExchangeRate
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "date") {
+			continue
+		}
+
+		rate, err := exchangeRateInput{Date: record[0], Base: record[1], Quote: record[2], Rate: json.Number(record[3])}.parse()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rates = append(rates, rate)
+	}
+}
+
+// loadExchangeRatesFile loads EXCHANGE_RATES_FILE, when set, into the
+// exchange_rates table on startup.
+func loadExchangeRatesFile() {
+	path := os.Getenv("EXCHANGE_RATES_FILE")
+	if path == "" {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		panic("❌ Failed to open EXCHANGE_RATES_FILE: " + err.Error())
+	}
+	defer f.Close()
+
+	rates, err := readExchangeRatesCSV(f)
+	if err != nil {
+		panic("❌ Invalid EXCHANGE_RATES_FILE: " + err.Error())
+	}
+	if err := saveExchangeRates(db, rates); err != nil {
+		panic("❌ Failed to load exchange rates: " + err.Error())
+	}
+
+	println("✅ Loaded", len(rates), "exchange rates")
+}
+
+// rateOn returns how many units of quote one unit of base was worth on
+// date, using the newest rate on or before that day. Missing pairs are
+// derived from the inverse rate or through a currency both are quoted in.
+func rateOn(base, quote string, date time.Time) (*big.Rat, time.Time, error) {
+	if base == quote {
+		return big.NewRat(1, 1), date, nil
+	}
+	day := date.Format("2006-01-02")
+
+	var rate ExchangeRate
+	err := db.Where("base = ? AND quote = ? AND date <= ?", base, quote, day).Order("date DESC").First(&rate).Error
+	if err == nil {
+		r, _ := new(big.Rat).SetString(rate.Rate)
+		return r, rate.Date, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, time.Time{}, err
+	}
+
+	err = db.Where("base = ? AND quote = ? AND date <= ?", quote, base, day).Order("date DESC").First(&rate).Error
+	if err == nil {
+		r, _ := new(big.Rat).SetString(rate.Rate)
+		return r.Inv(r), rate.Date, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, time.Time{}, err
+	}
+
+	var pivots []string
+	if err := db.Model(&ExchangeRate{}).
+		Where("quote IN ? AND date <= ?", []string{base, quote}, day).
+		Group("base").Having("COUNT(DISTINCT quote) = 2").
+		Pluck("base", &pivots).Error; err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, pivot := range pivots {
+		var from, to ExchangeRate
+		if db.Where("base = ? AND quote = ? AND date <= ?", pivot, base, day).Order("date DESC").First(&from).Error != nil {
+			continue
+		}
+		if db.Where("base = ? AND quote = ? AND date <= ?", pivot, quote, day).Order("date DESC").First(&to).Error != nil {
+			continue
+		}
+		fromRate, _ := new(big.Rat).SetString(from.Rate)
+		toRate, _ := new(big.Rat).SetString(to.Rate)
+		rateDate := from.Date
+		if to.Date.Before(rateDate) {
+			rateDate = to.Date
+		}
+		return new(big.Rat).Quo(toRate, fromRate), rateDate, nil
+	}
+
+	return nil, time.Time{}, errNoExchangeRate
+}
+
+// convertMinorUnits converts minor units of from into minor units of to,
+// rounding half away from zero. It fails with errConversionOverflow when
+// the result doesn't fit in an int64.
+func convertMinorUnits(minor int64, from, to string, rate *big.Rat) (int64, error) {
+	v := new(big.Rat).Mul(big.NewRat(minor, 1), rate)
+	scale := currencyScale(to) - currencyScale(from)
+	factor := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(scale))), nil))
+	if scale >= 0 {
+		v.Mul(v, factor)
+	} else {
+		v.Quo(v, factor)
+	}
+
+	num, den := v.Num(), v.Denom()
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	}
+	if !q.IsInt64() {
+		return 0, errConversionOverflow
+	}
+	return q.Int64(), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// rateKey identifies a cached rate lookup.
+type rateKey struct {
+	from, to, day string
+}
+
+type cachedRate struct {
+	rate *big.Rat
+	date time.Time
+	err  error
+}
+
+// convertExpenses fills in Converted on each expense with its amount in
+// the base currency. Expenses without a usable rate, or too large to
+// convert, are left without one.
+func convertExpenses(expenses []Expenses, base string) error {
+	cache := map[rateKey]cachedRate{}
+	for i := range expenses {
+		e := &expenses[i]
+		key := rateKey{e.Currency, base, e.SpentAt.Format("2006-01-02")}
+		cached, ok := cache[key]
+		if !ok {
+			cached.rate, cached.date, cached.err = rateOn(e.Currency, base, e.SpentAt)
+			cache[key] = cached
+		}
+		if errors.Is(cached.err, errNoExchangeRate) {
+			continue
+		}
+		if cached.err != nil {
+			return cached.err
+		}
+
+		minor, err := convertMinorUnits(e.AmountMinor, e.Currency, base, cached.rate)
+		if err != nil {
+			continue
+		}
+		e.Converted = &ConvertedAmount{
+			Amount:      json.Number(FormatMinorUnits(minor, base)),
+			AmountMinor: minor,
+			Currency:    base,
+			Rate:        cached.rate.FloatString(12),
+			RateDate:    cached.date,
+		}
+	}
+	return nil
+}
+
+// wantsConversion reports whether the request asked for base-currency
+// amounts with ?convert=true.
+func wantsConversion(c *gin.Context) bool {
+	return c.Query("convert") == "true" || c.Query("convert") == "1"
+}
+
+func ListExchangeRates(c *gin.Context) {
+	query := db.Order("date DESC, base, quote")
+	if base := c.Query("base"); base != "" {
+		query = query.Where("base = ?", strings.ToUpper(base))
+	}
+	if quote := c.Query("quote"); quote != "" {
+		query = query.Where("quote = ?", strings.ToUpper(quote))
+	}
+	if date := c.Query("date"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Date must be formatted as YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("date = ?", day.Format("2006-01-02"))
+	}
+
+	var rates []ExchangeRate
+	if err := query.Limit(1000).Find(&rates).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, rates)
+}
+
+// AdminImportExchangeRates stores rates sent as a JSON array or, with
+// Content-Type text/csv, as "date,base,quote,rate" lines.
+func AdminImportExchangeRates(c *gin.Context) {
+	var rates []ExchangeRate
+
+	if c.ContentType() == "text/csv" {
+		parsed, err := readExchangeRatesCSV(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"message": err.Error()})
+			return
+		}
+		rates = parsed
+	} else {
+		var req []exchangeRateInput
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"message": "Expected a JSON array of {date, base, quote, rate}"})
+			return
+		}
+		errs := ValidationErrors{}
+		for i, in := range req {
+			rate, err := in.parse()
+			if err != nil {
+				errs.Add(fmt.Sprintf("%d", i), err.Error())
+				continue
+			}
+			rates = append(rates, rate)
+		}
+		if len(errs) > 0 {
+			respondValidation(c, errs)
+			return
+		}
+	}
+
+	if err := saveExchangeRates(db, rates); err != nil {
+		c.JSON(500, gin.H{"message": "Failed to save exchange rates"})
+		return
+	}
+
+	c.JSON(200, gin.H{"imported": len(rates)})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyConfig describes one JWT key in the JSON file pointed to by
+// JWT_KEYS_FILE. HMAC keys use Secret; RS256 and EdDSA keys use PEM files.
+// A key without a private part can still verify tokens, which is how a
+// retired key is kept around until its tokens expire.
+type KeyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type KeysConfig struct {
+	Active string      `json:"active"`
+	Keys   []KeyConfig `json:"keys"`
+}
+
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring holds every key the API accepts and the one it signs with.
+type Keyring struct {
+	active  *SigningKey
+	keys    map[string]*SigningKey
+	methods []string
+}
+
+var signingKeys *Keyring
+
+var supportedAlgorithms = map[string]jwt.SigningMethod{
+	"HS256": jwt.SigningMethodHS256,
+	"HS384": jwt.SigningMethodHS384,
+	"HS512": jwt.SigningMethodHS512,
+	"RS256": jwt.SigningMethodRS256,
+	"EdDSA": jwt.SigningMethodEdDSA,
+}
+
+// loadKeys reads JWT_KEYS_FILE, or falls back to a single HS256 key from
+// JWT_SECRET.
+func loadKeys() {
+	var cfg KeysConfig
+
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			panic("❌ Failed to read JWT_KEYS_FILE: " + err.Error())
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			panic("❌ Failed to parse JWT_KEYS_FILE: " + err.Error())
+		}
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		cfg = KeysConfig{
+			Active: "default",
+			Keys:   []KeyConfig{{ID: "default", Algorithm: "HS256", Secret: secret}},
+		}
+	} else {
+		panic("❌ JWT_SECRET or JWT_KEYS_FILE must be set")
+	}
+
+	keyring, err := NewKeyring(cfg)
+	if err != nil {
+		panic("❌ Invalid JWT key configuration: " + err.Error())
+	}
+	signingKeys = keyring
+}
+
+func NewKeyring(cfg KeysConfig) (*Keyring, error) {
+	k := &Keyring{keys: map[string]*SigningKey{}}
+	seen := map[string]bool{}
+
+	for _, kc := range cfg.Keys {
+		if kc.ID == "" {
+			return nil, errors.New("every key needs a kid")
+		}
+		if _, dup := k.keys[kc.ID]; dup {
+			return nil, fmt.Errorf("duplicate kid %q", kc.ID)
+		}
+
+		key, err := parseKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kc.ID, err)
+		}
+		k.keys[kc.ID] = key
+
+		if !seen[kc.Algorithm] {
+			seen[kc.Algorithm] = true
+			k.methods = append(k.methods, kc.Algorithm)
+		}
+	}
+
+	active, ok := k.keys[cfg.Active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q is not configured", cfg.Active)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key", cfg.Active)
+	}
+	k.active = active
+
+	return k, nil
+}
+
+func parseKey(kc KeyConfig) (*SigningKey, error) {
+	method, ok := supportedAlgorithms[kc.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+	key := &SigningKey{ID: kc.ID, Method: method}
+
+	switch kc.Algorithm {
+	case "HS256", "HS384", "HS512":
+		if len(kc.Secret) < 32 {
+			return nil, errors.New("HMAC secret must be at least 32 bytes")
+		}
+		key.signKey = []byte(kc.Secret)
+		key.verifyKey = []byte(kc.Secret)
+
+	case "RS256":
+		if kc.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(kc.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		}
+		if kc.PublicKeyFile != "" {
+			pem, err := os.ReadFile(kc.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			public, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	case "EdDSA":
+		if kc.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(kc.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			private, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, errors.New("private key is not an Ed25519 key")
+			}
+			key.signKey = private
+			key.verifyKey = private.Public()
+		}
+		if kc.PublicKeyFile != "" {
+			pem, err := os.ReadFile(kc.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			public, err := jwt.ParseEdPublicKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+	}
+
+	if key.verifyKey == nil {
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	return key, nil
+}
+
+// Sign signs claims with the active key and sets the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.signKey)
+}
+
+// Parse verifies a token against the key named by its kid header. Only
+// the configured algorithms are accepted, and the token's alg must match
+// the algorithm of that specific key.
+func (k *Keyring) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q", t.Method.Alg())
+		}
+		return key.verifyKey, nil
+	}, append(opts, jwt.WithValidMethods(k.methods))...)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email. Production deployments can plug in an
+// SMTP or provider-backed implementation; the outbox mailers below are for
+// development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var mailer Mailer
+
+// OutboxMailer keeps sent messages in memory.
+type OutboxMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (m *OutboxMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// FileMailer writes each message to its own file in Dir.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"), suffix)
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", msg.To, msg.Subject, msg.Body)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0o600)
+}
+
+// setupMailer writes mail to MAIL_OUTBOX_DIR when set, otherwise keeps it
+// in memory.
+func setupMailer() {
+	if dir := os.Getenv("MAIL_OUTBOX_DIR"); dir != "" {
+		mailer = &FileMailer{Dir: dir}
+		return
+	}
+	mailer = &OutboxMailer{}
+}
+
+// appBaseURL is used to build links sent by email.
+func appBaseURL() string {
+	if url := os.Getenv("APP_BASE_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:9090"
+}
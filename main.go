@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
@@ -15,10 +18,67 @@ import (
 
 type Expenses struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"index;not null"`
+	User        *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Type        string    `json:"type" gorm:"size:10;not null;default:expense;index"`
 	Description string    `json:"description"`
-	Amount      string    `json:"amount"`
+	CategoryID  *uint     `json:"category_id" gorm:"index"`
+	Category    *Category `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	MerchantID  *uint     `json:"merchant_id" gorm:"index"`
+	Merchant    *Merchant `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	AccountID   *uint     `json:"account_id" gorm:"index"`
+	Account     *Account  `json:"-" gorm:"constraint:OnDelete:RESTRICT"`
+	AmountMinor int64     `json:"amount_minor" gorm:"not null;default:0"`
+	Currency    string    `json:"currency" gorm:"size:3;not null;default:USD"`
+	SpentAt     time.Time `json:"spent_at" gorm:"index"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Set on expenses created from a recurring template. The unique index
+	// keeps an occurrence from being created twice.
+	RecurringID *uint              `json:"recurring_id" gorm:"uniqueIndex:idx_expense_occurrence"`
+	Recurring   *RecurringTemplate `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	Occurrence  *time.Time         `json:"occurrence,omitempty" gorm:"uniqueIndex:idx_expense_occurrence"`
+
+	Tags            []Tag            `json:"-" gorm:"many2many:expense_tags;joinForeignKey:ExpenseID"`
+	Converted       *ConvertedAmount `json:"converted,omitempty" gorm:"-"`
+	FormattedAmount string           `json:"formatted_amount,omitempty" gorm:"-"`
+}
+
+// MarshalJSON adds "amount", the exact decimal value of AmountMinor, as a
+// JSON number, and lists tags by name.
+func (e Expenses) MarshalJSON() ([]byte, error) {
+	type expense Expenses
+	tags := make([]string, 0, len(e.Tags))
+	for _, t := range e.Tags {
+		tags = append(tags, t.Name)
+	}
+	return json.Marshal(struct {
+		expense
+		Amount json.Number `json:"amount"`
+		Tags   []string    `json:"tags"`
+	}{expense(e), json.Number(FormatMinorUnits(e.AmountMinor, e.Currency)), tags})
+}
+
+type User struct {
+	ID                 uint   `gorm:"primaryKey"`
+	Email              string `gorm:"unique"`
+	Password           string
+	PasswordChangedAt  *time.Time
+	EmailVerifiedAt    *time.Time
+	VerificationSentAt *time.Time
+	Role               string `gorm:"size:20;not null;default:user"`
+	DisabledAt         *time.Time
+	TOTPSecret         string     `gorm:"column:totp_secret;size:64"`
+	TOTPEnabledAt      *time.Time `gorm:"column:totp_enabled_at"`
+	TOTPLastCounter    int64      `gorm:"column:totp_last_counter;not null;default:0"`
+	DisplayName        string     `gorm:"size:100"`
+	Currency           string     `gorm:"size:3;not null;default:USD"`
+	BaseCurrency       string     `gorm:"size:3"`
+	Timezone           string     `gorm:"size:64"`
+	Locale             string     `gorm:"size:35;not null;default:en-US"`
+	WeekStart          string     `gorm:"size:9;not null;default:monday"`
+	CreatedAt          time.Time
 }
 
 // Global DB
@@ -33,23 +93,146 @@ func connectDB() {
 		panic("❌ Failed to connect to database")
 	}
 
+	if err := db.AutoMigrate(&User{}); err != nil {
+		panic("❌ Failed to migrate Users table")
+	}
+
+	if err := db.AutoMigrate(&Category{}); err != nil {
+		panic("❌ Failed to migrate Categories table")
+	}
+
+	if err := db.AutoMigrate(&Account{}); err != nil {
+		panic("❌ Failed to migrate Accounts table")
+	}
+
+	if err := db.AutoMigrate(&Merchant{}, &MerchantAlias{}); err != nil {
+		panic("❌ Failed to migrate Merchants tables")
+	}
+
+	if err := db.AutoMigrate(&Tag{}); err != nil {
+		panic("❌ Failed to migrate Tags table")
+	}
+
+	if err := db.SetupJoinTable(&RecurringTemplate{}, "Tags", &RecurringTemplateTag{}); err != nil {
+		panic("❌ Failed to set up recurring template tags")
+	}
+
+	if err := db.AutoMigrate(&RecurringTemplate{}); err != nil {
+		panic("❌ Failed to migrate Recurring templates table")
+	}
+
+	if err := db.SetupJoinTable(&Expenses{}, "Tags", &ExpenseTag{}); err != nil {
+		panic("❌ Failed to set up expense tags")
+	}
+
+	assignExpenseOwners()
+
 	if err := db.AutoMigrate(&Expenses{}); err != nil {
 		panic("❌ Failed to migrate Expenses table")
 	}
 
+	migrateLegacyAmounts()
+	backfillSpentAt()
+
+	if err := db.AutoMigrate(&RefreshToken{}, &RevokedToken{}, &PasswordResetToken{}, &APIToken{}, &RecoveryCode{}, &OIDCLoginState{}, &UserIdentity{}, &AuthAttempt{}, &Session{}, &ExchangeRate{}, &Transfer{}, &RecurringSkip{}); err != nil {
+		panic("❌ Failed to migrate token tables")
+	}
+
+	promoteAdmins()
+	seedCategories()
+	loadExchangeRatesFile()
+
 	println("✅ Database connected successfully")
 }
 
 
-func SignUp(c *gin.Context) {
-	type User struct {
-		ID       uint   `gorm:"primaryKey"`
-		Email    string `gorm:"unique"`
-		Password string
+// assignExpenseOwners gets expenses recorded before they had an owner ready
+// for the NOT NULL user_id foreign key. user_id is added as a nullable
+// column first, then rows without a valid owner are given to the account
+// in LEGACY_EXPENSES_OWNER (an email), or deleted when it is "delete".
+// Without it startup stops rather than guess whose expenses they are.
+func assignExpenseOwners() {
+	if !db.Migrator().HasTable(&Expenses{}) {
+		return
+	}
+	if !db.Migrator().HasColumn(&Expenses{}, "user_id") {
+		if err := db.Exec("ALTER TABLE expenses ADD COLUMN user_id bigint unsigned NULL").Error; err != nil {
+			panic("❌ Failed to add expenses.user_id: " + err.Error())
+		}
+	}
+
+	const orphaned = "user_id IS NULL OR user_id NOT IN (SELECT id FROM users)"
+
+	var count int64
+	if err := db.Table("expenses").Where(orphaned).Count(&count).Error; err != nil {
+		panic("❌ Failed to check expense owners: " + err.Error())
+	}
+	if count > 0 {
+		assignOrphanedExpenses(orphaned, count)
+	}
+
+	// AutoMigrate never tightens a nullable column, so do it here once
+	// every row has an owner.
+	columns, err := db.Migrator().ColumnTypes(&Expenses{})
+	if err != nil {
+		panic("❌ Failed to read expenses columns: " + err.Error())
 	}
+	for _, column := range columns {
+		if nullable, ok := column.Nullable(); ok && nullable && column.Name() == "user_id" {
+			if err := db.Exec("ALTER TABLE expenses MODIFY user_id bigint unsigned NOT NULL").Error; err != nil {
+				panic("❌ Failed to make expenses.user_id NOT NULL: " + err.Error())
+			}
+		}
+	}
+}
 
-	db.AutoMigrate(&User{})
 
+func assignOrphanedExpenses(orphaned string, count int64) {
+	owner := os.Getenv("LEGACY_EXPENSES_OWNER")
+	switch owner {
+	case "":
+		panic(fmt.Sprintf("❌ %d expenses have no owner. Set LEGACY_EXPENSES_OWNER to the email of the account they belong to, or to \"delete\" to remove them", count))
+
+	case "delete":
+		if err := db.Exec("DELETE FROM expenses WHERE " + orphaned).Error; err != nil {
+			panic("❌ Failed to delete expenses without an owner: " + err.Error())
+		}
+		println("✅ Deleted", count, "expenses without an owner")
+
+	default:
+		var user User
+		if err := db.Where("email = ?", normalizeEmail(owner)).First(&user).Error; err != nil {
+			panic("❌ LEGACY_EXPENSES_OWNER " + owner + " is not an account: " + err.Error())
+		}
+		if err := db.Exec("UPDATE expenses SET user_id = ? WHERE "+orphaned, user.ID).Error; err != nil {
+			panic("❌ Failed to assign expenses without an owner: " + err.Error())
+		}
+		println("✅ Assigned", count, "expenses without an owner to", user.Email)
+	}
+}
+
+
+func GenerateToken(user User, sessionID string) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		UserID:    user.ID,
+		Roles:     user.Roles(),
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+	}
+	return signingKeys.Sign(claims)
+}
+
+func SignUp(c *gin.Context) {
 	var req struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -60,6 +243,20 @@ func SignUp(c *gin.Context) {
 		return
 	}
 
+	req.Email = normalizeEmail(req.Email)
+
+	errs := ValidationErrors{}
+	for _, problem := range validateEmail(req.Email) {
+		errs.Add("email", problem)
+	}
+	for _, problem := range passwordPolicy.Check(req.Password, req.Email) {
+		errs.Add("password", problem)
+	}
+	if len(errs) > 0 {
+		respondValidation(c, errs)
+		return
+	}
+
 	var existing User
 	db.Where("email = ?", req.Email).First(&existing)
 	if existing.ID != 0 {
@@ -67,7 +264,11 @@ func SignUp(c *gin.Context) {
 		return
 	}
 
-	hashed, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to hash password"})
+		return
+	}
 
 	user := User{Email: req.Email, Password: string(hashed)}
 	if err := db.Create(&user).Error; err != nil {
@@ -75,48 +276,160 @@ func SignUp(c *gin.Context) {
 		return
 	}
 
-	secret := []byte("SECRET_KEY")
-	claims := jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(2 * time.Hour).Unix(),
+	// The account works right away; a failed mail can be re-sent from
+	// /verify/resend.
+	if err := sendVerificationEmail(&user); err != nil {
+		println("⚠️ Failed to send verification email:", err.Error())
+	}
+
+	tokens, err := IssueTokenPair(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to generate token"})
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, _ := token.SignedString(secret)
 
 	c.JSON(200, gin.H{
-		"message": "User successfully registered",
-		"token":   signedToken,
+		"message":       "User successfully registered",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
+// dummyPasswordHash is compared against when no user has the email, so an
+// unknown address takes as long to reject as a wrong password.
+var dummyPasswordHash = []byte("$2a$10$1epGVdNrNGzIkQr.HSNYl.F2ac/DsnmHHxXV6UkyjLR0imZYGDUpS")
 
-func ValidateToken(tokenString string) (*jwt.Token, error) {
-	secret := []byte("SECRET_KEY")
-	return jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+func Login(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request"})
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	attemptKey := accountAttemptKey("login", req.Email)
+	if !checkAttempts(c, attemptKey) {
+		return
+	}
+
+	// Same response for unknown email and wrong password so callers
+	// can't probe which accounts exist.
+	var user User
+	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		recordFailure(attemptKey)
+		c.JSON(401, gin.H{"message": "Invalid email or password"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		recordFailure(attemptKey)
+		c.JSON(401, gin.H{"message": "Invalid email or password"})
+		return
+	}
+
+	attempts.Reset(attemptKey)
+
+	completeLogin(c, user)
 }
 
-func AddExpense(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(401, gin.H{"message": "Missing Authorization header"})
+// completeLogin finishes a login once the user has been authenticated by
+// password or single sign-on.
+func completeLogin(c *gin.Context, user User) {
+	if user.DisabledAt != nil {
+		c.JSON(403, gin.H{"message": "Account is disabled"})
 		return
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := ValidateToken(tokenString)
-	if err != nil || !token.Valid {
-		c.JSON(401, gin.H{"message": "Invalid or expired token"})
+	// With 2FA enabled the first factor only earns a short-lived mfa_token,
+	// which /login/2fa exchanges for real tokens.
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := IssueMFAToken(user.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Failed to generate token"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"message":      "Two-factor authentication required",
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
 		return
 	}
 
-	var body map[string]interface{}
-	if err := c.BindJSON(&body); err != nil {
-		c.JSON(400, gin.H{"message": "Invalid request body"})
+	tokens, err := IssueTokenPair(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to generate token"})
 		return
 	}
 
+	c.JSON(200, gin.H{
+		"message":       "Login successful",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+
+func ValidateToken(tokenString string) (*jwt.Token, error) {
+	token, err := signingKeys.Parse(tokenString, &Claims{})
+	if err != nil {
+		return token, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.ID == "" || len(claims.Audience) > 0 {
+		return token, jwt.ErrTokenInvalidClaims
+	}
+
+	revoked, err := isTokenRevoked(claims.ID)
+	if err != nil {
+		return token, err
+	}
+	if revoked {
+		return token, ErrTokenRevoked
+	}
+
+	if claims.SessionID != "" {
+		if err := checkSession(claims.SessionID, claims.UserID); err != nil {
+			return token, err
+		}
+	}
+
+	// Tokens issued before the last password change are no longer valid.
+	var user User
+	if err := db.Select("id", "password_changed_at", "disabled_at").First(&user, claims.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return token, ErrTokenRevoked
+		}
+		return token, err
+	}
+	if user.DisabledAt != nil {
+		return token, ErrAccountDisabled
+	}
+	if user.PasswordChangedAt != nil && claims.IssuedAt != nil &&
+		claims.IssuedAt.Time.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+		return token, ErrTokenRevoked
+	}
+
+	return token, nil
+}
+
+// newExpenseFromBody validates an expense or income body and builds the
+// row to insert, along with the tag names to attach. It writes the error
+// response and returns false when the body is invalid. The merchant is left
+// to the caller's transaction, as resolving it may create one.
+func newExpenseFromBody(c *gin.Context, body map[string]interface{}, user User) (Expenses, []string, bool) {
+	userID := user.ID
+
 	desc, _ := body["description"].(string)
 	if desc == "" {
 		if v, ok := body["Description"].(string); ok {
@@ -125,73 +438,147 @@ func AddExpense(c *gin.Context) {
 	}
 	if desc == "" {
 		c.JSON(400, gin.H{"message": "description is required"})
-		return
+		return Expenses{}, nil, false
 	}
 
-	var amountFloat float64
-	found := false
-	tryKeys := []string{"amount", "Amount"}
-	for _, key := range tryKeys {
-		if v, ok := body[key]; ok {
-			switch val := v.(type) {
-			case float64:
-				amountFloat = val
-				found = true
-			case int:
-				amountFloat = float64(val)
-				found = true
-			case int64:
-				amountFloat = float64(val)
-				found = true
-			case string:
-				if parsed, err := strconv.ParseFloat(val, 64); err == nil {
-					amountFloat = parsed
-					found = true
-				}
-			}
-			if found {
-				break
-			}
+	account, _, err := accountFromBody(body, userID)
+	if errors.Is(err, errAccountNotFound) {
+		c.JSON(400, gin.H{"message": "account_id must be one of your accounts"})
+		return Expenses{}, nil, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return Expenses{}, nil, false
+	}
+
+	code := user.Currency
+	if account != nil {
+		code = account.Currency
+	}
+	if v, ok := body["currency"].(string); ok && v != "" {
+		parsed, err := parseCurrency(v)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "currency must be an ISO 4217 code"})
+			return Expenses{}, nil, false
 		}
+		code = parsed
+	}
+	if account != nil && code != account.Currency {
+		c.JSON(400, gin.H{"message": "currency must match the account's currency " + account.Currency})
+		return Expenses{}, nil, false
 	}
 
+	raw, found := amountFromBody(body)
 	if !found {
 		c.JSON(400, gin.H{"message": "amount is required and must be a number"})
-		return
+		return Expenses{}, nil, false
+	}
+
+	amountMinor, err := ParseMinorUnits(raw, code)
+	if err != nil || amountMinor <= 0 {
+		c.JSON(400, gin.H{"message": "amount must be a positive number with at most " + strconv.Itoa(currencyScale(code)) + " decimal places"})
+		return Expenses{}, nil, false
 	}
 
-	amountFormatted := fmt.Sprintf("%.2f$", amountFloat)
+	categoryID, _, err := categoryFromBody(body, userID)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "category_id must be a category you can see"})
+		return Expenses{}, nil, false
+	}
+
+	tagNames, _, err := tagsFromBody(body)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return Expenses{}, nil, false
+	}
+
+	txType, found, err := typeFromBody(body)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return Expenses{}, nil, false
+	}
+	if !found {
+		txType = TypeExpense
+	}
+
+	now := time.Now().In(user.Location())
+
+	spentAt, found, err := dateTimeFromBody(body, "spent_at", user.Location())
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return Expenses{}, nil, false
+	}
+	if !found {
+		spentAt = now
+	}
 
 	expense := Expenses{
+		UserID:      userID,
+		Type:        txType,
 		Description: desc,
-		Amount:      amountFormatted,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CategoryID:  categoryID,
+		AccountID:   accountIDOf(account),
+		AmountMinor: amountMinor,
+		Currency:    code,
+		SpentAt:     spentAt,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
-	if err := db.Create(&expense).Error; err != nil {
-		c.JSON(500, gin.H{"message": "Failed to add expense"})
+	return expense, tagNames, true
+}
+
+func AddExpense(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
 		return
 	}
 
-	c.JSON(201, expense)
-}
-
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
 
-func UpdateExpense(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(401, gin.H{"message": "Missing Authorization header"})
+	expense, tagNames, ok := newExpenseFromBody(c, body, user)
+	if !ok {
 		return
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := ValidateToken(tokenString)
-	if err != nil || !token.Valid {
-		c.JSON(401, gin.H{"message": "Invalid or expired token"})
+	err := db.Transaction(func(tx *gorm.DB) error {
+		merchantID, _, err := merchantFromBody(tx, body, userID, expense.Description)
+		if err != nil {
+			return err
+		}
+		expense.MerchantID = merchantID
+
+		tags, err := findOrCreateTags(tx, userID, tagNames)
+		if err != nil {
+			return err
+		}
+		expense.Tags = tags
+		return tx.Create(&expense).Error
+	})
+	if errors.Is(err, errMerchantNotFound) {
+		c.JSON(400, gin.H{"message": "merchant_id must be one of your merchants"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to add expense"})
 		return
 	}
 
+	expense.Localize(user)
+	c.JSON(201, expense)
+}
+
+
+func UpdateExpense(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
 	id := c.Param("id")
 	if id == "" {
 		c.JSON(400, gin.H{"message": "Expense ID is required"})
@@ -204,8 +591,9 @@ func UpdateExpense(c *gin.Context) {
 		return
 	}
 
+	// Other users' expenses are reported as not found.
 	var expense Expenses
-	result := db.First(&expense, expenseID)
+	result := db.Where("user_id = ?", userID).First(&expense, expenseID)
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			c.JSON(404, gin.H{"message": "Expense not found"})
@@ -221,79 +609,184 @@ func UpdateExpense(c *gin.Context) {
 		return
 	}
 
-	if desc, ok := body["description"].(string); ok && desc != "" {
-		expense.Description = desc
-	} else if desc, ok := body["Description"].(string); ok && desc != "" {
+	desc, _ := body["description"].(string)
+	if desc == "" {
+		desc, _ = body["Description"].(string)
+	}
+	if desc != "" {
 		expense.Description = desc
 	}
 
-	var amountFloat float64
-	found := false
-	tryKeys := []string{"amount", "Amount"}
-	for _, key := range tryKeys {
-		if v, ok := body[key]; ok {
-			switch val := v.(type) {
-			case float64:
-				amountFloat = val
-				found = true
-			case int:
-				amountFloat = float64(val)
-				found = true
-			case int64:
-				amountFloat = float64(val)
-				found = true
-			case string:
-				if parsed, err := strconv.ParseFloat(val, 64); err == nil {
-					amountFloat = parsed
-					found = true
-				}
-			}
-			if found {
-				break
-			}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	account, accountFound, err := accountFromBody(body, userID)
+	if errors.Is(err, errAccountNotFound) {
+		c.JSON(400, gin.H{"message": "account_id must be one of your accounts"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if !accountFound && expense.AccountID != nil {
+		current, err := findAccount(userID, *expense.AccountID)
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Database error"})
+			return
 		}
+		account = &current
+	}
+
+	code := expense.Currency
+	if v, ok := body["currency"].(string); ok && v != "" {
+		parsed, err := parseCurrency(v)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "currency must be an ISO 4217 code"})
+			return
+		}
+		code = parsed
+	}
+	if account != nil && code != account.Currency {
+		c.JSON(400, gin.H{"message": "currency must match the account's currency " + account.Currency})
+		return
+	}
+	expense.AccountID = accountIDOf(account)
+
+	raw, found := amountFromBody(body)
+	if found {
+		amountMinor, err := ParseMinorUnits(raw, code)
+		if err != nil || amountMinor <= 0 {
+			c.JSON(400, gin.H{"message": "amount must be a positive number with at most " + strconv.Itoa(currencyScale(code)) + " decimal places"})
+			return
+		}
+		expense.AmountMinor = amountMinor
+	} else if code != expense.Currency {
+		// Changing only the currency keeps the decimal value, so 12.50 USD
+		// becomes 12.50 EUR rather than 1250 of the new minor unit.
+		amountMinor, err := ParseMinorUnits(FormatMinorUnits(expense.AmountMinor, expense.Currency), code)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "amount doesn't fit the new currency, send amount as well"})
+			return
+		}
+		expense.AmountMinor = amountMinor
+	}
+	expense.Currency = code
+
+	categoryID, found, err := categoryFromBody(body, userID)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "category_id must be a category you can see"})
+		return
+	}
+	if found {
+		expense.CategoryID = categoryID
+	}
+
+	tagNames, tagsFound, err := tagsFromBody(body)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	spentAt, found, err := dateTimeFromBody(body, "spent_at", user.Location())
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+	if found {
+		expense.SpentAt = spentAt
 	}
 
+	txType, found, err := typeFromBody(body)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
 	if found {
-		expense.Amount = fmt.Sprintf("%.2f$", amountFloat)
+		expense.Type = txType
+	}
+
+	// A new description only picks a merchant through the alias rules when
+	// the expense doesn't have one yet.
+	aliasText := ""
+	if desc != "" && expense.MerchantID == nil {
+		aliasText = desc
 	}
 
 	expense.UpdatedAt = time.Now()
 
-	if err := db.Save(&expense).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		merchantID, found, err := merchantFromBody(tx, body, userID, aliasText)
+		if err != nil {
+			return err
+		}
+		if found {
+			expense.MerchantID = merchantID
+		}
+
+		if err := tx.Save(&expense).Error; err != nil {
+			return err
+		}
+		if !tagsFound {
+			return tx.Model(&expense).Association("Tags").Find(&expense.Tags)
+		}
+		tags, err := findOrCreateTags(tx, userID, tagNames)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&expense).Association("Tags").Replace(tags)
+	})
+	if errors.Is(err, errMerchantNotFound) {
+		c.JSON(400, gin.H{"message": "merchant_id must be one of your merchants"})
+		return
+	}
+	if err != nil {
 		c.JSON(500, gin.H{"message": "Failed to update expense"})
 		return
 	}
 
+	expense.Localize(user)
 	c.JSON(200, expense)
 }
 
 func GetAllExpenses(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
 	var expenses []Expenses
 
-	result := db.Find(&expenses)
+	query, ok := typeFilter(c, db.Where("user_id = ?", userID))
+	if !ok {
+		return
+	}
+
+	result := query.Preload("Tags").Find(&expenses)
 	if result.Error != nil {
 		c.JSON(500, gin.H{"message": "Failed to fetch data"})
 		return
 	}
 
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	localizeExpenses(expenses, user)
+	if wantsConversion(c) {
+		if err := convertExpenses(expenses, user.ReportingCurrency()); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to convert amounts"})
+			return
+		}
+	}
 	c.JSON(200, expenses)
 }
 
 
 func DeleteExpense(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(401, gin.H{"message": "Missing Authorization header"})
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := ValidateToken(tokenString)
-	if err != nil || !token.Valid {
-		c.JSON(401, gin.H{"message": "Invalid or expired token"})
-		return
-	}
+	userID := CurrentClaims(c).UserID
 
 	id := c.Param("id")
 	if id == "" {
@@ -307,8 +800,9 @@ func DeleteExpense(c *gin.Context) {
 		return
 	}
 
+	// Other users' expenses are reported as not found.
 	var expense Expenses
-	result := db.First(&expense, expenseID)
+	result := db.Where("user_id = ?", userID).First(&expense, expenseID)
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			c.JSON(404, gin.H{"message": "Expense not found"})
@@ -326,62 +820,221 @@ func DeleteExpense(c *gin.Context) {
 	c.Status(204)
 }
 
-func FilterExpenses(c *gin.Context) {
+// expenseDateFilter narrows query to the range/start/end parameters,
+// read in the user's time zone and applied to spent_at. It writes a 400
+// and returns false when the dates are invalid.
+func expenseDateFilter(c *gin.Context, query *gorm.DB, user User) (*gorm.DB, bool) {
 	rangeParam := c.Query("range")
 	startParam := c.Query("start")
 	endParam := c.Query("end")
 
-	var expenses []Expenses
-	query := db
+	loc := user.Location()
+	now := time.Now().In(loc)
 
-	now := time.Now()
+	if rangeParam == "this_week" {
+		query = query.Where("spent_at >= ?", startOfWeek(now, user.FirstDayOfWeek()))
+	}
+
+	if rangeParam == "this_month" {
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		query = query.Where("spent_at >= ?", monthStart)
+	}
 
 	if rangeParam == "week" {
 		weekAgo := now.AddDate(0, 0, -7)
-		query = query.Where("created_at >= ?", weekAgo)
+		query = query.Where("spent_at >= ?", weekAgo)
 	}
 
 	if rangeParam == "month" {
 		monthAgo := now.AddDate(0, -1, 0)
-		query = query.Where("created_at >= ?", monthAgo)
+		query = query.Where("spent_at >= ?", monthAgo)
 	}
 
 	if rangeParam == "3months" {
 		threeMonthsAgo := now.AddDate(0, -3, 0)
-		query = query.Where("created_at >= ?", threeMonthsAgo)
+		query = query.Where("spent_at >= ?", threeMonthsAgo)
 	}
 
 	if startParam != "" && endParam != "" {
-		startTime, err1 := time.Parse("2006-01-02", startParam)
-		endTime, err2 := time.Parse("2006-01-02", endParam)
+		startTime, err1 := time.ParseInLocation("2006-01-02", startParam, loc)
+		endTime, err2 := time.ParseInLocation("2006-01-02", endParam, loc)
 		if err1 != nil || err2 != nil {
 			c.JSON(400, gin.H{"message": "Date must be formatted as YYYY-MM-DD"})
+			return nil, false
+		}
+		// end is inclusive, so include everything spent that day.
+		query = query.Where("spent_at >= ? AND spent_at < ?", startTime, endTime.AddDate(0, 0, 1))
+	}
+
+	return query, true
+}
+
+func FilterExpenses(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	var expenses []Expenses
+	query, ok := expenseDateFilter(c, db.Where("user_id = ?", userID), user)
+	if !ok {
+		return
+	}
+
+	query, ok = typeFilter(c, query)
+	if !ok {
+		return
+	}
+
+	query, ok = tagFilter(c, query, userID)
+	if !ok {
+		return
+	}
+
+	if account := c.Query("account_id"); account != "" {
+		query = query.Where("account_id = ?", account)
+	}
+
+	if merchant := c.Query("merchant_id"); merchant != "" {
+		query = query.Where("merchant_id = ?", merchant)
+	}
+
+	if category := c.Query("category"); category != "" {
+		ids, err := resolveCategoryFilter(userID, category)
+		if errors.Is(err, errCategoryNotFound) {
+			c.JSON(404, gin.H{"message": "Category not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Database error"})
 			return
 		}
-		query = query.Where("created_at BETWEEN ? AND ?", startTime, endTime)
+		query = query.Where("category_id IN ?", ids)
 	}
 
-	result := query.Find(&expenses)
+	result := query.Preload("Tags").Find(&expenses)
 	if result.Error != nil {
 		c.JSON(500, gin.H{"message": "Failed to fetch expenses"})
 		return
 	}
 
+	localizeExpenses(expenses, user)
+	if wantsConversion(c) {
+		if err := convertExpenses(expenses, user.ReportingCurrency()); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to convert amounts"})
+			return
+		}
+	}
 	c.JSON(200, expenses)
 }
 
 
 
 func main() {
+	loadKeys()
+	setupMailer()
+	setupOIDC()
+	setupAttemptStore()
+	setupPasswordPolicy()
 	connectDB()
+	startScheduler()
+
+	// Keep JSON numbers exact so amounts never pass through float64.
+	binding.EnableDecoderUseNumber = true
 
 	r := gin.Default()
-	r.POST("/signup", SignUp)
-	r.POST("/expenses", AddExpense)
-	r.PUT("/expenses/:id", UpdateExpense)
-	r.GET("/expenses", GetAllExpenses)
-	r.DELETE("/expenses/:id", DeleteExpense)
-	r.GET("/expenses/filter", FilterExpenses)
+	r.POST("/signup", ThrottleByIP("signup", true), SignUp)
+	r.POST("/login", ThrottleByIP("login", false), Login)
+	r.POST("/login/2fa", ThrottleByIP("login-2fa", false), LoginTOTP)
+	r.POST("/token/refresh", ThrottleByIP("refresh", false), RefreshTokens)
+	r.POST("/password/forgot", ThrottleByIP("password-forgot", true), ForgotPassword)
+	r.POST("/password/reset", ThrottleByIP("password-reset", false), ResetPassword)
+	r.GET("/verify", VerifyEmail)
+	r.GET("/auth/oidc/login", OIDCLogin)
+	r.GET("/auth/oidc/callback", OIDCCallback)
+
+	protected := r.Group("/")
+	protected.Use(AuthMiddleware())
+	{
+		protected.POST("/expenses", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), AddExpense)
+		protected.PUT("/expenses/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), UpdateExpense)
+		protected.GET("/expenses", RequireScope(ScopeExpensesRead), GetAllExpenses)
+		protected.DELETE("/expenses/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteExpense)
+		protected.GET("/expenses/filter", RequireScope(ScopeExpensesRead), FilterExpenses)
+		protected.GET("/exchange-rates", RequireScope(ScopeExpensesRead), ListExchangeRates)
+
+		protected.GET("/categories", RequireScope(ScopeExpensesRead), ListCategories)
+		protected.POST("/categories", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateCategory)
+		protected.PATCH("/categories/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), UpdateCategory)
+		protected.DELETE("/categories/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteCategory)
+		protected.GET("/reports/categories", RequireScope(ScopeReportsRead), CategoryReport)
+
+		protected.GET("/merchants", RequireScope(ScopeExpensesRead), MerchantAutocomplete)
+		protected.POST("/merchants", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateMerchant)
+		protected.GET("/merchants/:id", RequireScope(ScopeExpensesRead), GetMerchant)
+		protected.PATCH("/merchants/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), RenameMerchant)
+		protected.DELETE("/merchants/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteMerchant)
+		protected.POST("/merchants/:id/aliases", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateMerchantAlias)
+		protected.DELETE("/merchants/:id/aliases/:alias_id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteMerchantAlias)
+		protected.GET("/reports/merchants", RequireScope(ScopeReportsRead), MerchantReport)
+
+		protected.GET("/accounts", RequireScope(ScopeExpensesRead), ListAccounts)
+		protected.POST("/accounts", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateAccount)
+		protected.PATCH("/accounts/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), UpdateAccount)
+		protected.DELETE("/accounts/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteAccount)
+		protected.GET("/reports/cashflow", RequireScope(ScopeReportsRead), CashFlow)
+		protected.GET("/accounts/balances", RequireScope(ScopeReportsRead), AccountBalances)
+		protected.GET("/accounts/:id/ledger", RequireScope(ScopeReportsRead), AccountLedger)
+		protected.GET("/transfers", RequireScope(ScopeExpensesRead), ListTransfers)
+		protected.POST("/transfers", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateTransfer)
+		protected.DELETE("/transfers/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteTransfer)
+
+		protected.GET("/recurring", RequireScope(ScopeExpensesRead), ListRecurring)
+		protected.POST("/recurring", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), CreateRecurring)
+		protected.GET("/recurring/:id", RequireScope(ScopeExpensesRead), GetRecurring)
+		protected.PATCH("/recurring/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), UpdateRecurring)
+		protected.DELETE("/recurring/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteRecurring)
+		protected.POST("/recurring/:id/pause", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), PauseRecurring)
+		protected.POST("/recurring/:id/resume", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), ResumeRecurring)
+		protected.POST("/recurring/:id/skip", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), SkipRecurring)
+
+		protected.GET("/tags", RequireScope(ScopeExpensesRead), ListTags)
+		protected.PATCH("/tags/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), RenameTag)
+		protected.POST("/tags/:id/merge", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), MergeTag)
+		protected.DELETE("/tags/:id", RequireScope(ScopeExpensesWrite), RequireVerifiedEmail(), DeleteTag)
+		protected.POST("/logout", Logout)
+		protected.POST("/verify/resend", RequireSession(), ResendVerification)
+
+		protected.POST("/tokens", RequireSession(), CreateAPIToken)
+		protected.GET("/tokens", RequireSession(), ListAPITokens)
+		protected.DELETE("/tokens/:id", RequireSession(), RevokeAPIToken)
+
+		protected.GET("/me", GetMe)
+		protected.PATCH("/me", RequireSession(), UpdateMe)
+		protected.GET("/me/sessions", RequireSession(), ListSessions)
+		protected.DELETE("/me/sessions/:id", RequireSession(), DeleteSession)
+		protected.GET("/me/export", RequireSession(), ExportMyData)
+		protected.DELETE("/me", RequireSession(), DeleteMe)
+
+		protected.POST("/2fa/enroll", RequireSession(), EnrollTOTP)
+		protected.POST("/2fa/confirm", RequireSession(), ConfirmTOTP)
+		protected.POST("/2fa/disable", RequireSession(), DisableTOTP)
+		protected.POST("/2fa/recovery-codes", RequireSession(), RegenerateRecoveryCodes)
+	}
+
+	admin := protected.Group("/admin")
+	admin.Use(RequireRole(RoleAdmin))
+	{
+		admin.GET("/users", AdminListUsers)
+		admin.POST("/users/:id/disable", AdminDisableUser)
+		admin.POST("/users/:id/enable", AdminEnableUser)
+		admin.PUT("/users/:id/role", AdminSetRole)
+		admin.GET("/stats", AdminStats)
+		admin.POST("/exchange-rates", AdminImportExchangeRates)
+	}
 
 	r.Run(":9090")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// mockDB points the global db at a sqlmock connection that speaks MySQL
+// for the rest of the test. Every expectation must be met by the end.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gdb, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = gdb
+	t.Cleanup(func() {
+		db = previous
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+	})
+	return mock
+}
+
+// captureArg matches any string argument and stores it.
+type captureArg struct{ into *string }
+
+func (a captureArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*a.into = s
+	return ok
+}
+
+// validChars matches a valid UTF-8 string of exactly n characters.
+type validChars int
+
+func (n validChars) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && utf8.ValidString(s) && utf8.RuneCountInString(s) == int(n)
+}
+
+// newTestContext builds a request context for userID, as AuthMiddleware
+// would leave it.
+func newTestContext(userID uint, method, target, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set(claimsKey, &Claims{UserID: userID})
+	return c, w
+}
+
+func TestDummyPasswordHashCostsAsMuchAsARealOne(t *testing.T) {
+	cost, err := bcrypt.Cost(dummyPasswordHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, want %d like hashes made at sign-up", cost, bcrypt.DefaultCost)
+	}
+}
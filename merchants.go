@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	AliasExact    = "exact"
+	AliasPrefix   = "prefix"
+	AliasContains = "contains"
+)
+
+// Merchant is the canonical payee a user's expenses are linked to.
+type Merchant struct {
+	ID        uint            `json:"id" gorm:"primaryKey"`
+	UserID    uint            `json:"-" gorm:"not null;uniqueIndex:idx_merchant_user_name"`
+	User      *User           `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Name      string          `json:"name" gorm:"size:100;not null;uniqueIndex:idx_merchant_user_name"`
+	Aliases   []MerchantAlias `json:"aliases,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// MerchantAlias maps raw text such as "STARBUCKS #123" to a merchant.
+// Pattern is stored normalized and compared against the normalized text.
+type MerchantAlias struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"-" gorm:"not null;uniqueIndex:idx_merchant_alias"`
+	User       *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	MerchantID uint      `json:"merchant_id" gorm:"not null;index"`
+	Pattern    string    `json:"pattern" gorm:"size:100;not null;uniqueIndex:idx_merchant_alias"`
+	MatchType  string    `json:"match" gorm:"size:10;not null;default:exact;uniqueIndex:idx_merchant_alias"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var validAliasMatches = map[string]bool{
+	AliasExact:    true,
+	AliasPrefix:   true,
+	AliasContains: true,
+}
+
+var (
+	errMerchantNotFound = errors.New("merchant not found")
+	errDuplicateAlias   = errors.New("duplicate alias")
+)
+
+// normalizeMerchantText lower-cases raw text, turns punctuation into
+// spaces and drops store numbers, so "STARBUCKS #123" and "Starbucks"
+// compare equal.
+func normalizeMerchantText(raw string) string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '&' && r != '\''
+	}) {
+		if strings.IndexFunc(word, func(r rune) bool { return !unicode.IsDigit(r) }) == -1 {
+			continue
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// matches reports whether the alias applies to normalized text.
+func (a MerchantAlias) matches(text string) bool {
+	switch a.MatchType {
+	case AliasPrefix:
+		return text == a.Pattern || strings.HasPrefix(text, a.Pattern+" ")
+	case AliasContains:
+		return strings.Contains(" "+text+" ", " "+a.Pattern+" ")
+	default:
+		return text == a.Pattern
+	}
+}
+
+// matchAlias picks the merchant for normalized text. Exact aliases win
+// over prefix ones, which win over contains; within a kind the longest
+// pattern wins.
+func matchAlias(aliases []MerchantAlias, text string) *uint {
+	if text == "" {
+		return nil
+	}
+
+	rank := map[string]int{AliasExact: 0, AliasPrefix: 1, AliasContains: 2}
+	sort.SliceStable(aliases, func(i, j int) bool {
+		if rank[aliases[i].MatchType] != rank[aliases[j].MatchType] {
+			return rank[aliases[i].MatchType] < rank[aliases[j].MatchType]
+		}
+		return len(aliases[i].Pattern) > len(aliases[j].Pattern)
+	})
+	for _, a := range aliases {
+		if a.matches(text) {
+			id := a.MerchantID
+			return &id
+		}
+	}
+	return nil
+}
+
+// resolveMerchant finds the merchant raw refers to: an alias rule first,
+// then a merchant with the same normalized name. With create set, an
+// unknown merchant is created under the raw name.
+func resolveMerchant(tx *gorm.DB, userID uint, raw string, create bool) (*uint, error) {
+	text := normalizeMerchantText(raw)
+	if text == "" {
+		return nil, nil
+	}
+
+	var aliases []MerchantAlias
+	if err := tx.Where("user_id = ?", userID).Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+	if id := matchAlias(aliases, text); id != nil {
+		return id, nil
+	}
+
+	var merchants []Merchant
+	if err := tx.Where("user_id = ?", userID).Find(&merchants).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range merchants {
+		if normalizeMerchantText(m.Name) == text {
+			id := m.ID
+			return &id, nil
+		}
+	}
+
+	if !create {
+		return nil, nil
+	}
+	name := strings.Join(strings.Fields(raw), " ")
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+	m := Merchant{UserID: userID, Name: name}
+	if err := tx.Create(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m.ID, nil
+}
+
+// merchantFromBody works out the merchant for an expense body. An explicit
+// "merchant_id" (null clears it) wins, then a raw "merchant" string, which
+// creates the merchant when unknown. Without either, the description is
+// checked against the alias rules. Run it in the transaction that saves the
+// expense so a rejected request doesn't leave a new merchant behind.
+func merchantFromBody(tx *gorm.DB, body map[string]interface{}, userID uint, description string) (id *uint, present bool, err error) {
+	if v, ok := body["merchant_id"]; ok {
+		if v == nil {
+			return nil, true, nil
+		}
+		var raw string
+		switch val := v.(type) {
+		case json.Number:
+			raw = string(val)
+		case string:
+			raw = val
+		}
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, true, errMerchantNotFound
+		}
+		var m Merchant
+		if err := tx.Where("user_id = ?", userID).First(&m, parsed).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, true, errMerchantNotFound
+			}
+			return nil, true, err
+		}
+		return &m.ID, true, nil
+	}
+
+	if v, ok := body["merchant"].(string); ok && strings.TrimSpace(v) != "" {
+		id, err := resolveMerchant(tx, userID, v, true)
+		return id, true, err
+	}
+
+	if description != "" {
+		id, err := resolveMerchant(tx, userID, description, false)
+		return id, id != nil, err
+	}
+	return nil, false, nil
+}
+
+// MerchantAutocomplete returns up to 10 merchants whose name, or a word
+// in it, or an alias starts with ?q=, the most used first.
+func MerchantAutocomplete(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+	q := strings.TrimSpace(c.Query("q"))
+
+	query := db.Table("merchants").
+		Select("merchants.id, merchants.name, COUNT(expenses.id) AS uses").
+		Joins("LEFT JOIN expenses ON expenses.merchant_id = merchants.id AND expenses.user_id = merchants.user_id").
+		Where("merchants.user_id = ?", userID)
+	if q != "" {
+		like := escapeLike(q) + "%"
+		aliasLike := escapeLike(normalizeMerchantText(q)) + "%"
+		query = query.Where(
+			"merchants.name LIKE ? OR merchants.name LIKE ? OR merchants.id IN (?)",
+			like, "% "+like,
+			db.Model(&MerchantAlias{}).Select("merchant_id").Where("user_id = ? AND pattern LIKE ?", userID, aliasLike),
+		)
+	}
+
+	var results []struct {
+		ID   uint   `json:"id"`
+		Name string `json:"name"`
+		Uses int64  `json:"uses"`
+	}
+	if err := query.Group("merchants.id, merchants.name").Order("uses DESC, merchants.name").Limit(10).Scan(&results).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, results)
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func CreateMerchant(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	name := strings.Join(strings.Fields(req.Name), " ")
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		c.JSON(400, gin.H{"message": "name is required and must be at most 100 characters"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&Merchant{}).Where("user_id = ? AND name = ?", userID, name).Count(&count).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if count > 0 {
+		c.JSON(409, gin.H{"message": "A merchant with this name already exists"})
+		return
+	}
+
+	m := Merchant{UserID: userID, Name: name}
+	if err := db.Create(&m).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create merchant"})
+		return
+	}
+
+	c.JSON(201, m)
+}
+
+// ownMerchant loads the merchant in :id with its aliases. Other users'
+// merchants are reported as not found.
+func ownMerchant(c *gin.Context) (Merchant, bool) {
+	var m Merchant
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid merchant ID"})
+		return m, false
+	}
+
+	err = db.Where("user_id = ?", CurrentClaims(c).UserID).Preload("Aliases").First(&m, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"message": "Merchant not found"})
+		return m, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return m, false
+	}
+
+	return m, true
+}
+
+func GetMerchant(c *gin.Context) {
+	m, ok := ownMerchant(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, m)
+}
+
+func RenameMerchant(c *gin.Context) {
+	m, ok := ownMerchant(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	name := strings.Join(strings.Fields(req.Name), " ")
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		c.JSON(400, gin.H{"message": "name is required and must be at most 100 characters"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&Merchant{}).Where("user_id = ? AND name = ? AND id <> ?", m.UserID, name, m.ID).Count(&count).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if count > 0 {
+		c.JSON(409, gin.H{"message": "A merchant with this name already exists"})
+		return
+	}
+
+	if err := db.Model(&m).Update("name", name).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to rename merchant"})
+		return
+	}
+
+	c.JSON(200, m)
+}
+
+// DeleteMerchant removes a merchant and its aliases. Its expenses are
+// kept without a merchant.
+func DeleteMerchant(c *gin.Context) {
+	m, ok := ownMerchant(c)
+	if !ok {
+		return
+	}
+
+	if err := db.Select("Aliases").Delete(&m).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete merchant"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// CreateMerchantAlias adds an alias rule and links the user's existing
+// expenses without a merchant whose description it matches.
+func CreateMerchantAlias(c *gin.Context) {
+	m, ok := ownMerchant(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Pattern string `json:"pattern"`
+		Match   string `json:"match"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	if req.Match == "" {
+		req.Match = AliasExact
+	}
+	if !validAliasMatches[req.Match] {
+		c.JSON(400, gin.H{"message": "match must be exact, prefix or contains"})
+		return
+	}
+	pattern := normalizeMerchantText(req.Pattern)
+	if pattern == "" || utf8.RuneCountInString(pattern) > 100 {
+		c.JSON(400, gin.H{"message": "pattern is required and must be at most 100 characters"})
+		return
+	}
+
+	alias := MerchantAlias{UserID: m.UserID, MerchantID: m.ID, Pattern: pattern, MatchType: req.Match}
+	var linked int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&MerchantAlias{}).Where("user_id = ? AND pattern = ? AND match_type = ?", m.UserID, pattern, req.Match).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errDuplicateAlias
+		}
+		if err := tx.Create(&alias).Error; err != nil {
+			return err
+		}
+
+		var expenses []Expenses
+		if err := tx.Select("id", "description").Where("user_id = ? AND merchant_id IS NULL", m.UserID).Find(&expenses).Error; err != nil {
+			return err
+		}
+		var ids []uint
+		for _, e := range expenses {
+			if alias.matches(normalizeMerchantText(e.Description)) {
+				ids = append(ids, e.ID)
+			}
+		}
+		linked = len(ids)
+		if len(ids) == 0 {
+			return nil
+		}
+		return tx.Model(&Expenses{}).Where("id IN ?", ids).Update("merchant_id", m.ID).Error
+	})
+	if errors.Is(err, errDuplicateAlias) {
+		c.JSON(409, gin.H{"message": "This alias already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create alias"})
+		return
+	}
+
+	c.JSON(201, gin.H{"alias": alias, "linked_expenses": linked})
+}
+
+func DeleteMerchantAlias(c *gin.Context) {
+	m, ok := ownMerchant(c)
+	if !ok {
+		return
+	}
+
+	aliasID, err := strconv.ParseUint(c.Param("alias_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid alias ID"})
+		return
+	}
+
+	result := db.Where("merchant_id = ? AND id = ?", m.ID, aliasID).Delete(&MerchantAlias{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete alias"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"message": "Alias not found"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// MerchantReport returns the number of expenses and totals per currency
+// for each merchant, most used first.
+func MerchantReport(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	query, ok := expenseDateFilter(c, db.Model(&Expenses{}).Where("user_id = ?", userID), user)
+	if !ok {
+		return
+	}
+	query, ok = typeFilter(c, query)
+	if !ok {
+		return
+	}
+
+	var sums []struct {
+		MerchantID *uint
+		Currency   string
+		Count      int64
+		Total      int64
+	}
+	if err := query.Select("merchant_id, currency, COUNT(*) AS count, SUM(amount_minor) AS total").
+		Group("merchant_id, currency").Scan(&sums).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to build report"})
+		return
+	}
+
+	var merchants []Merchant
+	if err := db.Where("user_id = ?", userID).Find(&merchants).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	names := map[uint]string{}
+	for _, m := range merchants {
+		names[m.ID] = m.Name
+	}
+
+	type merchantTotal struct {
+		MerchantID *uint                  `json:"merchant_id"`
+		Name       string                 `json:"name"`
+		Count      int64                  `json:"count"`
+		Totals     map[string]json.Number `json:"totals"`
+
+		totals map[string]int64
+	}
+	byMerchant := map[uint]*merchantTotal{}
+	unassigned := &merchantTotal{totals: map[string]int64{}}
+	for _, s := range sums {
+		row := unassigned
+		if s.MerchantID != nil {
+			row = byMerchant[*s.MerchantID]
+			if row == nil {
+				row = &merchantTotal{MerchantID: s.MerchantID, Name: names[*s.MerchantID], totals: map[string]int64{}}
+				byMerchant[*s.MerchantID] = row
+			}
+		}
+		row.Count += s.Count
+		row.totals[s.Currency] += s.Total
+	}
+
+	rows := make([]*merchantTotal, 0, len(byMerchant))
+	for _, row := range byMerchant {
+		row.Totals = formatTotals(row.totals)
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		return rows[i].Name < rows[j].Name
+	})
+
+	c.JSON(200, gin.H{
+		"merchants": rows,
+		"unassigned": gin.H{
+			"count":  unassigned.Count,
+			"totals": formatTotals(unassigned.totals),
+		},
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func expectUser(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT \\* FROM `users`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "currency"}).AddRow(1, "ann@example.com", "EUR"))
+}
+
+func TestAddExpenseRejectedBodyCreatesNoMerchant(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+
+	c, w := newTestContext(1, "POST", "/expenses", `{"description":"Coffee","amount":4.2,"merchant":"Blue Bottle","spent_at":"yesterday"}`)
+	AddExpense(c)
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestAddExpenseCreatesMerchantWithExpense(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `merchant_aliases`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT \\* FROM `merchants`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT INTO `merchants`").
+		WithArgs(1, "Blue Bottle", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec("INSERT INTO `expenses`").WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectCommit()
+
+	c, w := newTestContext(1, "POST", "/expenses", `{"description":"Coffee","amount":4.2,"merchant":"  Blue   Bottle "}`)
+	AddExpense(c)
+	if w.Code != 201 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestResolveMerchantTruncatesByCharacter(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT \\* FROM `merchant_aliases`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT \\* FROM `merchants`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT INTO `merchants`").
+		WithArgs(1, validChars(100), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+
+	id, err := resolveMerchant(db, 1, "C"+strings.Repeat("é", 150), true)
+	if err != nil || id == nil || *id != 5 {
+		t.Fatalf("resolveMerchant = %v, %v", id, err)
+	}
+}
+
+func TestNormalizeMerchantText(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{"STARBUCKS #123", "starbucks"},
+		{"Starbucks", "starbucks"},
+		{"  Trader Joe's  ", "trader joe's"},
+		{"AMZN Mktp US*2K4", "amzn mktp us 2k4"},
+		{"H&M 0042 Berlin", "h&m berlin"},
+		{"Café-Müller", "café müller"},
+		{"7-Eleven", "eleven"},
+		{"#1234", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeMerchantText(tt.raw); got != tt.want {
+			t.Errorf("normalizeMerchantText(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAlias(t *testing.T) {
+	aliases := []MerchantAlias{
+		{MerchantID: 1, Pattern: "amzn", MatchType: AliasContains},
+		{MerchantID: 2, Pattern: "amzn mktp", MatchType: AliasPrefix},
+		{MerchantID: 3, Pattern: "amzn mktp us", MatchType: AliasPrefix},
+		{MerchantID: 4, Pattern: "amzn mktp us", MatchType: AliasExact},
+		{MerchantID: 5, Pattern: "sq", MatchType: AliasPrefix},
+	}
+	tests := []struct {
+		text string
+		want uint // 0 for no match
+	}{
+		{"amzn mktp us", 4},
+		{"amzn mktp us 2k4", 3},
+		{"amzn mktp de", 2},
+		{"paid amzn digital", 1},
+		{"amznprime", 0},
+		{"sq blue bottle", 5},
+		{"square", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		got := matchAlias(aliases, tt.text)
+		switch {
+		case tt.want == 0 && got != nil:
+			t.Errorf("matchAlias(%q) = %d, want no match", tt.text, *got)
+		case tt.want != 0 && (got == nil || *got != tt.want):
+			t.Errorf("matchAlias(%q) = %v, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCreateMerchantCountsCharacters(t *testing.T) {
+	name := strings.Repeat("é", 100)
+
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM `merchants`").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO `merchants`").
+		WithArgs(1, name, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+
+	c, w := newTestContext(1, "POST", "/merchants", `{"name":"`+name+`"}`)
+	CreateMerchant(c)
+	if w.Code != 201 {
+		t.Fatalf("status %d, want 201: %s", w.Code, w.Body)
+	}
+
+	c, w = newTestContext(1, "POST", "/merchants", `{"name":"`+name+`é"}`)
+	CreateMerchant(c)
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestDeleteMerchantAliasRejectsBadID(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT \\* FROM `merchants`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name"}).AddRow(3, 1, "Blue Bottle"))
+	mock.ExpectQuery("SELECT \\* FROM `merchant_aliases`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	c, w := newTestContext(1, "DELETE", "/merchants/3/aliases/1%20OR%201=1", "")
+	c.Params = gin.Params{{Key: "id", Value: "3"}, {Key: "alias_id", Value: "1 OR 1=1"}}
+	DeleteMerchantAlias(c)
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+}
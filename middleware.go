@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims carried by every access token issued by this API.
+type Claims struct {
+	UserID    uint     `json:"user_id"`
+	Roles     []string `json:"roles,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+
+	// Set only for personal access tokens, which are not JWTs.
+	Scopes     []string `json:"-"`
+	APITokenID uint     `json:"-"`
+}
+
+const claimsKey = "claims"
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func randomHex(n int) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newTokenID() (string, error) {
+	return randomHex(16)
+}
+
+func abortUnauthorized(c *gin.Context, code, message string) {
+	c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	c.AbortWithStatusJSON(401, gin.H{"error": code, "message": message})
+}
+
+// AuthMiddleware validates the bearer token and stores its claims on the
+// context. Handlers behind it read them with CurrentClaims.
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			abortUnauthorized(c, "token_missing", "Missing Authorization header")
+			return
+		}
+
+		tokenString, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok || strings.TrimSpace(tokenString) == "" {
+			abortUnauthorized(c, "token_malformed", "Authorization header must be 'Bearer <token>'")
+			return
+		}
+
+		tokenString = strings.TrimSpace(tokenString)
+		if strings.HasPrefix(tokenString, apiTokenPrefix) {
+			claims, err := ValidateAPIToken(tokenString)
+			switch {
+			case errors.Is(err, errAPITokenExpired):
+				abortUnauthorized(c, "token_expired", "Token has expired")
+				return
+			case errors.Is(err, ErrTokenRevoked):
+				abortUnauthorized(c, "token_revoked", "Token has been revoked")
+				return
+			case errors.Is(err, ErrAccountDisabled):
+				abortUnauthorized(c, "account_disabled", "Account is disabled")
+				return
+			case err != nil:
+				abortUnauthorized(c, "token_invalid", "Invalid token")
+				return
+			}
+
+			c.Set(claimsKey, claims)
+			c.Next()
+			return
+		}
+
+		token, err := ValidateToken(tokenString)
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			abortUnauthorized(c, "token_expired", "Token has expired")
+			return
+		case errors.Is(err, ErrTokenRevoked):
+			abortUnauthorized(c, "token_revoked", "Token has been revoked")
+			return
+		case errors.Is(err, ErrAccountDisabled):
+			abortUnauthorized(c, "account_disabled", "Account is disabled")
+			return
+		case errors.Is(err, jwt.ErrTokenMalformed):
+			abortUnauthorized(c, "token_malformed", "Token is malformed")
+			return
+		case err != nil || !token.Valid:
+			abortUnauthorized(c, "token_invalid", "Invalid token")
+			return
+		}
+
+		claims, ok := token.Claims.(*Claims)
+		if !ok || claims.UserID == 0 {
+			abortUnauthorized(c, "token_invalid", "Invalid token claims")
+			return
+		}
+
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// CurrentClaims returns the claims stored by AuthMiddleware.
+func CurrentClaims(c *gin.Context) *Claims {
+	return c.MustGet(claimsKey).(*Claims)
+}
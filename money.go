@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/currency"
+	"gorm.io/gorm"
+)
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// decimalPattern is the only amount syntax accepted: no exponents,
+// fractions, hex, digit separators or leading "+".
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// parseDecimal reads a plain decimal string exactly.
+func parseDecimal(raw string) (*big.Rat, bool) {
+	raw = strings.TrimSpace(raw)
+	if !decimalPattern.MatchString(raw) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(raw)
+}
+
+// parseCurrency validates an ISO 4217 code and returns it upper-cased.
+func parseCurrency(code string) (string, error) {
+	unit, err := currency.ParseISO(strings.TrimSpace(code))
+	if err != nil {
+		return "", err
+	}
+	return unit.String(), nil
+}
+
+// currencyScale is the number of minor-unit digits, e.g. 2 for USD and 0
+// for JPY.
+func currencyScale(code string) int {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return 2
+	}
+	scale, _ := currency.Standard.Rounding(unit)
+	return scale
+}
+
+// ParseMinorUnits turns a decimal string such as "12.5" into minor units
+// of the currency (1250 cents) without going through float64. Amounts
+// with more decimals than the currency has are rejected. Negative values
+// parse; callers decide whether they make sense.
+func ParseMinorUnits(raw, code string) (int64, error) {
+	r, ok := parseDecimal(raw)
+	if !ok {
+		return 0, errInvalidAmount
+	}
+
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyScale(code))), nil)
+	r.Mul(r, new(big.Rat).SetInt(factor))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%w: %s allows %d decimal places", errInvalidAmount, code, currencyScale(code))
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("%w: out of range", errInvalidAmount)
+	}
+
+	return r.Num().Int64(), nil
+}
+
+// FormatMinorUnits renders minor units as a plain decimal string, e.g.
+// 1250 USD -> "12.50".
+func FormatMinorUnits(minor int64, code string) string {
+	scale := currencyScale(code)
+	if scale == 0 {
+		return strconv.FormatInt(minor, 10)
+	}
+
+	// Negate as unsigned so math.MinInt64 doesn't overflow.
+	sign, n := "", uint64(minor)
+	if minor < 0 {
+		sign, n = "-", -n
+	}
+	digits := fmt.Sprintf("%0*d", scale+1, n)
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// amountFromBody reads "amount" (or "Amount") from a decoded JSON body.
+// present reports whether the key was sent at all.
+func amountFromBody(body map[string]interface{}) (raw string, present bool) {
+	for _, key := range []string{"amount", "Amount"} {
+		v, ok := body[key]
+		if !ok {
+			continue
+		}
+		switch val := v.(type) {
+		case json.Number:
+			return string(val), true
+		case float64:
+			return strconv.FormatFloat(val, 'f', -1, 64), true
+		case string:
+			return val, true
+		default:
+			return "", true
+		}
+	}
+	return "", false
+}
+
+var legacyCurrencySymbols = map[string]string{
+	"$": "USD",
+	"€": "EUR",
+	"£": "GBP",
+	"¥": "JPY",
+	"￥": "JPY",
+}
+
+// parseLegacyAmount reads the formatted strings the amount column used to
+// hold, such as "12.50$", "$ 1,234.50" or "€ 1.234,50".
+func parseLegacyAmount(s string) (int64, string, error) {
+	code := "USD"
+	for symbol, c := range legacyCurrencySymbols {
+		if strings.Contains(s, symbol) {
+			code = c
+		}
+	}
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool { return r < 'A' || r > 'Z' }) {
+		if parsed, err := parseCurrency(word); err == nil && len(word) == 3 {
+			code = parsed
+		}
+	}
+
+	var number strings.Builder
+	for _, r := range s {
+		if (r >= '0' && r <= '9') || r == '.' || r == ',' || r == '-' {
+			number.WriteRune(r)
+		}
+	}
+	n := number.String()
+
+	// The last separator is the decimal one when both are present; a lone
+	// comma is decimal only when it is followed by one or two digits.
+	lastDot, lastComma := strings.LastIndex(n, "."), strings.LastIndex(n, ",")
+	switch {
+	case lastDot >= 0 && lastComma >= 0 && lastComma > lastDot:
+		n = strings.ReplaceAll(n, ".", "")
+		n = strings.Replace(n, ",", ".", 1)
+	case lastDot >= 0 && lastComma >= 0:
+		n = strings.ReplaceAll(n, ",", "")
+	case lastComma >= 0 && len(n)-lastComma-1 <= 2 && strings.Count(n, ",") == 1:
+		n = strings.Replace(n, ",", ".", 1)
+	default:
+		n = strings.ReplaceAll(n, ",", "")
+	}
+
+	minor, err := ParseMinorUnits(n, code)
+	if err != nil {
+		return 0, "", fmt.Errorf("%q: %w", s, err)
+	}
+	return minor, code, nil
+}
+
+// migrateLegacyAmounts converts the old string amount column into
+// amount_minor and currency, then drops it. Startup stops if any row
+// can't be parsed, leaving the old column in place.
+func migrateLegacyAmounts() {
+	if !db.Migrator().HasColumn(&Expenses{}, "amount") {
+		return
+	}
+
+	var rows []struct {
+		ID     uint
+		Amount string
+	}
+	if err := db.Table("expenses").Select("id", "amount").Scan(&rows).Error; err != nil {
+		panic("❌ Failed to read legacy amounts: " + err.Error())
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			minor, code, err := parseLegacyAmount(row.Amount)
+			if err != nil {
+				return fmt.Errorf("expense %d: %w", row.ID, err)
+			}
+			if err := tx.Table("expenses").Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"amount_minor": minor,
+				"currency":     code,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic("❌ Failed to migrate legacy amounts: " + err.Error())
+	}
+
+	if err := db.Migrator().DropColumn(&Expenses{}, "amount"); err != nil {
+		panic("❌ Failed to drop legacy amount column: " + err.Error())
+	}
+
+	println("✅ Migrated", len(rows), "expense amounts to minor units")
+}
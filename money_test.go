@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseMinorUnits(t *testing.T) {
+	tests := []struct {
+		raw  string
+		code string
+		want int64
+		err  bool
+	}{
+		{"12.5", "USD", 1250, false},
+		{"12.50", "USD", 1250, false},
+		{" 7 ", "USD", 700, false},
+		{"0.01", "USD", 1, false},
+		{"-3.25", "EUR", -325, false},
+		{"1500", "JPY", 1500, false},
+		{"1.234", "BHD", 1234, false},
+		{"1.5", "JPY", 0, true},
+		{"0.001", "USD", 0, true},
+		{"5/2", "USD", 0, true},
+		{"0x10", "USD", 0, true},
+		{"1_000", "USD", 0, true},
+		{"1e2", "USD", 0, true},
+		{"+5", "USD", 0, true},
+		{".5", "USD", 0, true},
+		{"5.", "USD", 0, true},
+		{"1,5", "USD", 0, true},
+		{"", "USD", 0, true},
+		{"abc", "USD", 0, true},
+		{"99999999999999999999", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMinorUnits(tt.raw, tt.code)
+		if tt.err {
+			if !errors.Is(err, errInvalidAmount) {
+				t.Errorf("ParseMinorUnits(%q, %s) = %d, %v; want errInvalidAmount", tt.raw, tt.code, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMinorUnits(%q, %s) = %d, %v; want %d", tt.raw, tt.code, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatMinorUnits(t *testing.T) {
+	tests := []struct {
+		minor int64
+		code  string
+		want  string
+	}{
+		{1250, "USD", "12.50"},
+		{1, "USD", "0.01"},
+		{0, "EUR", "0.00"},
+		{-5, "USD", "-0.05"},
+		{-1250, "USD", "-12.50"},
+		{1500, "JPY", "1500"},
+		{1234, "BHD", "1.234"},
+		{math.MaxInt64, "USD", "92233720368547758.07"},
+		{math.MinInt64, "USD", "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := FormatMinorUnits(tt.minor, tt.code); got != tt.want {
+			t.Errorf("FormatMinorUnits(%d, %s) = %q, want %q", tt.minor, tt.code, got, tt.want)
+		}
+		if back, err := ParseMinorUnits(FormatMinorUnits(tt.minor, tt.code), tt.code); err != nil || back != tt.minor {
+			t.Errorf("round trip of %d %s = %d, %v", tt.minor, tt.code, back, err)
+		}
+	}
+}
+
+func TestParseLegacyAmount(t *testing.T) {
+	tests := []struct {
+		in    string
+		minor int64
+		code  string
+	}{
+		{"12.50$", 1250, "USD"},
+		{"$ 1,234.50", 123450, "USD"},
+		{"€ 1.234,50", 123450, "EUR"},
+		{"12,5 €", 1250, "EUR"},
+		{"£3", 300, "GBP"},
+		{"¥1,500", 1500, "JPY"},
+		{"1500 JPY", 1500, "JPY"},
+		{"12.00 CHF", 1200, "CHF"},
+		{"1,234", 123400, "USD"},
+		{"-4.20$", -420, "USD"},
+		{"7", 700, "USD"},
+	}
+	for _, tt := range tests {
+		minor, code, err := parseLegacyAmount(tt.in)
+		if err != nil || minor != tt.minor || code != tt.code {
+			t.Errorf("parseLegacyAmount(%q) = %d %s, %v; want %d %s", tt.in, minor, code, err, tt.minor, tt.code)
+		}
+	}
+
+	for _, in := range []string{"", "free", "$", "1.5 JPY"} {
+		if minor, code, err := parseLegacyAmount(in); err == nil {
+			t.Errorf("parseLegacyAmount(%q) = %d %s, want an error", in, minor, code)
+		}
+	}
+}
+
+func TestExchangeRateInputRejectsNonDecimalRates(t *testing.T) {
+	for _, rate := range []string{"1.087", "161", "0.000001"} {
+		in := exchangeRateInput{Date: "2026-01-01", Base: "EUR", Quote: "USD", Rate: json.Number(rate)}
+		if _, err := in.parse(); err != nil {
+			t.Errorf("rate %q: %v", rate, err)
+		}
+	}
+	for _, rate := range []string{"0", "-1", "1e2", "5/2", "0x10", "1_0", ""} {
+		in := exchangeRateInput{Date: "2026-01-01", Base: "EUR", Quote: "USD", Rate: json.Number(rate)}
+		if _, err := in.parse(); err == nil {
+			t.Errorf("rate %q was accepted", rate)
+		}
+	}
+}
+
+func TestExchangeRateInputKeepsDateInLocalTime(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-5", -5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	rate, err := exchangeRateInput{Date: "2026-01-01", Base: "EUR", Quote: "USD", Rate: "1.08"}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rate.Date.In(time.Local).Format("2006-01-02 15:04"); got != "2026-01-01 00:00" {
+		t.Errorf("rate date in local time = %s, want 2026-01-01 00:00", got)
+	}
+}
+
+func TestConvertMinorUnits(t *testing.T) {
+	tests := []struct {
+		minor    int64
+		from, to string
+		rate     string
+		want     int64
+	}{
+		{1250, "USD", "EUR", "0.92", 1150},
+		{-1250, "USD", "EUR", "0.92", -1150},
+		{1, "USD", "EUR", "0.5", 1},
+		{-1, "USD", "EUR", "0.5", -1},
+		{1000, "EUR", "JPY", "161.2", 1612},
+		{1612, "JPY", "EUR", "0.0062", 999},
+		{1000, "USD", "BHD", "0.376", 3760},
+	}
+	for _, tt := range tests {
+		rate, _ := new(big.Rat).SetString(tt.rate)
+		got, err := convertMinorUnits(tt.minor, tt.from, tt.to, rate)
+		if err != nil || got != tt.want {
+			t.Errorf("convertMinorUnits(%d %s -> %s at %s) = %d, %v; want %d", tt.minor, tt.from, tt.to, tt.rate, got, err, tt.want)
+		}
+	}
+
+	rate, _ := new(big.Rat).SetString("20")
+	if got, err := convertMinorUnits(math.MaxInt64/10, "USD", "EUR", rate); !errors.Is(err, errConversionOverflow) {
+		t.Errorf("overflowing conversion = %d, %v; want errConversionOverflow", got, err)
+	}
+}
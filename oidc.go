@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateTTL        = 10 * time.Minute
+	oidcJWKSMinInterval = time.Minute
+)
+
+var (
+	errEmailNotVerified   = errors.New("email not verified by provider")
+	errAccountNotVerified = errors.New("existing account has not verified its email")
+)
+
+// OIDCConfig is read from the environment. Single sign-on is off unless
+// OIDC_ISSUER and OIDC_CLIENT_ID are set.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+}
+
+// OIDCLoginState holds the per-login secrets between the redirect to the
+// provider and the callback. It lives in the database so any replica can
+// handle the callback.
+type OIDCLoginState struct {
+	State        string    `gorm:"primaryKey;size:64"`
+	Nonce        string    `gorm:"size:64;not null"`
+	CodeVerifier string    `gorm:"size:128;not null"`
+	ExpiresAt    time.Time `gorm:"index;not null"`
+}
+
+// UserIdentity links an account to a subject at an external provider.
+type UserIdentity struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	User      *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Issuer    string `gorm:"size:255;uniqueIndex:idx_identity_subject;not null"`
+	Subject   string `gorm:"size:255;uniqueIndex:idx_identity_subject;not null"`
+	CreatedAt time.Time
+}
+
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCProvider caches the discovery document and signing keys of the
+// configured identity provider.
+type OIDCProvider struct {
+	Config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+var oidcProvider *OIDCProvider
+
+func setupOIDC() {
+	cfg := OIDCConfig{
+		Issuer:       strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       os.Getenv("OIDC_SCOPES"),
+	}
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = appBaseURL() + "/auth/oidc/callback"
+	}
+	if cfg.Scopes == "" {
+		cfg.Scopes = "openid email profile"
+	}
+
+	oidcProvider = &OIDCProvider{
+		Config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *OIDCProvider) Discovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.Config.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.Config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.Config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the provider key with the given kid, refetching the JWKS
+// (at most once a minute) when the kid is unknown so provider key
+// rotation is picked up.
+func (p *OIDCProvider) key(kid string) (interface{}, error) {
+	d, err := p.Discovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcJWKSMinInterval {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		point := append([]byte{4}, append(leftPad(x, 32), leftPad(y, 32)...)...)
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// VerifyIDToken checks the signature against the provider's JWKS and the
+// iss, aud, exp and nonce claims.
+func (p *OIDCProvider) VerifyIDToken(raw, nonce string) (*IDTokenClaims, error) {
+	var claims IDTokenClaims
+	token, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.Config.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid id_token")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	return &claims, nil
+}
+
+// Exchange trades an authorization code for the provider's id_token.
+func (p *OIDCProvider) Exchange(code, codeVerifier string) (string, error) {
+	d, err := p.Discovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	resp, err := p.client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: status %d %s", resp.StatusCode, body.Error)
+	}
+
+	return body.IDToken, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func OIDCLogin(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(404, gin.H{"message": "Single sign-on is not configured"})
+		return
+	}
+
+	d, err := oidcProvider.Discovery()
+	if err != nil {
+		c.JSON(502, gin.H{"message": "Identity provider is unavailable"})
+		return
+	}
+
+	state, err1 := randomHex(32)
+	nonce, err2 := randomHex(32)
+	verifier, err3 := randomHex(48)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.JSON(500, gin.H{"message": "Failed to start login"})
+		return
+	}
+
+	db.Where("expires_at < ?", time.Now()).Delete(&OIDCLoginState{})
+	if err := db.Create(&OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to start login"})
+		return
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", oidcProvider.Config.ClientID)
+	params.Set("redirect_uri", oidcProvider.Config.RedirectURL)
+	params.Set("scope", oidcProvider.Config.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	c.Redirect(302, d.AuthorizationEndpoint+separator+params.Encode())
+}
+
+func OIDCCallback(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(404, gin.H{"message": "Single sign-on is not configured"})
+		return
+	}
+
+	if errParam := c.Query("error"); errParam != "" {
+		c.JSON(401, gin.H{"message": "Login was rejected by the identity provider", "error": errParam})
+		return
+	}
+
+	code := c.Query("code")
+	state := c.Query("state")
+	if code == "" || state == "" {
+		c.JSON(400, gin.H{"message": "code and state are required"})
+		return
+	}
+
+	// The state row is deleted on first use so a callback can't be replayed.
+	var login OIDCLoginState
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state = ?", state).First(&login).Error; err != nil {
+			return err
+		}
+		result := tx.Where("state = ?", state).Delete(&OIDCLoginState{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil || time.Now().After(login.ExpiresAt) {
+		c.JSON(400, gin.H{"message": "Invalid or expired login state"})
+		return
+	}
+
+	rawIDToken, err := oidcProvider.Exchange(code, login.CodeVerifier)
+	if err != nil {
+		c.JSON(502, gin.H{"message": "Failed to exchange authorization code"})
+		return
+	}
+
+	claims, err := oidcProvider.VerifyIDToken(rawIDToken, login.Nonce)
+	if err != nil {
+		c.JSON(401, gin.H{"message": "Invalid ID token"})
+		return
+	}
+
+	user, err := linkOIDCUser(oidcProvider.Config.Issuer, claims)
+	if errors.Is(err, errEmailNotVerified) {
+		c.JSON(403, gin.H{"message": "The identity provider has not verified this email address"})
+		return
+	}
+	if errors.Is(err, errAccountNotVerified) {
+		c.JSON(409, gin.H{"message": "An account with this email exists but its email is not verified. Sign in with your password and verify it first"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to sign in"})
+		return
+	}
+
+	completeLogin(c, *user)
+}
+
+// linkOIDCUser finds the account for an external identity. An unknown
+// identity is linked to the account with the same email, or a new account
+// is created, but only when the provider says the email is verified.
+// Accounts that never verified their email are not linked: whoever signed
+// up with it may not own the address and would keep password access.
+func linkOIDCUser(issuer string, claims *IDTokenClaims) (*User, error) {
+	var identity UserIdentity
+	err := db.Where("issuer = ? AND subject = ?", issuer, claims.Subject).First(&identity).Error
+	if err == nil {
+		var user User
+		if err := db.First(&user, identity.UserID).Error; err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	email := normalizeEmail(claims.Email)
+	if !claims.EmailVerified || validateEmail(email) != nil {
+		return nil, errEmailNotVerified
+	}
+
+	var user User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("email = ?", email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// SSO-only accounts get an unusable random password; they can
+			// set one later through the password reset flow.
+			secret, err := randomHex(32)
+			if err != nil {
+				return err
+			}
+			hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			user = User{Email: email, Password: string(hashed), EmailVerifiedAt: &now}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if user.EmailVerifiedAt == nil {
+			return errAccountNotVerified
+		}
+
+		return tx.Create(&UserIdentity{UserID: user.ID, Issuer: issuer, Subject: claims.Subject}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "expense-tracker"
+	testRedirectURL = "http://app.test/auth/oidc/callback"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS, an authorize
+// endpoint that approves every request and a token endpoint that checks
+// PKCE.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	Subject       string
+	Email         string
+	EmailVerified bool
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, Subject: "user-1", Email: "ann@example.com", EmailVerified: true, codes: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad request", 400)
+		return
+	}
+
+	code := rand.Text()
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	idp.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), 302)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func() {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+	}
+
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != testRedirectURL ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		fail()
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, IDTokenClaims{
+		Nonce:         grant.nonce,
+		Email:         idp.Email,
+		EmailVerified: idp.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.URL,
+			Subject:   idp.Subject,
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = "test"
+	raw, err := token.SignedString(idp.key)
+	if err != nil {
+		fail()
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": raw, "token_type": "Bearer"})
+}
+
+// useMockIdP configures single sign-on against idp for the rest of the test.
+func useMockIdP(t *testing.T, idp *mockIdP) {
+	t.Helper()
+
+	previous := oidcProvider
+	oidcProvider = &OIDCProvider{
+		Config: OIDCConfig{Issuer: idp.URL, ClientID: testClientID, RedirectURL: testRedirectURL, Scopes: "openid email"},
+		client: idp.Client(),
+	}
+	t.Cleanup(func() { oidcProvider = previous })
+}
+
+func useTestKeys(t *testing.T) {
+	t.Helper()
+
+	keyring, err := NewKeyring(KeysConfig{
+		Active: "test",
+		Keys:   []KeyConfig{{ID: "test", Algorithm: "HS256", Secret: strings.Repeat("s", 32)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := signingKeys
+	signingKeys = keyring
+	t.Cleanup(func() { signingKeys = previous })
+}
+
+type oidcLogin struct {
+	state, nonce, verifier string
+}
+
+// startOIDCLogin runs OIDCLogin, follows the redirect through the mock
+// provider and returns the stored login and the code handed back.
+func startOIDCLogin(t *testing.T, mock sqlmock.Sqlmock, idp *mockIdP) (oidcLogin, string) {
+	t.Helper()
+
+	var login oidcLogin
+	mock.ExpectExec("DELETE FROM `o_id_c_login_states`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO `o_id_c_login_states`").
+		WithArgs(captureArg{&login.state}, captureArg{&login.nonce}, captureArg{&login.verifier}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/auth/oidc/login", nil)
+	OIDCLogin(c)
+	if w.Code != 302 {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+
+	authURL, _ := url.Parse(w.Header().Get("Location"))
+	q := authURL.Query()
+	if q.Get("state") != login.state || q.Get("nonce") != login.nonce {
+		t.Fatalf("redirect does not carry the stored state and nonce: %s", authURL)
+	}
+	if q.Get("code_challenge") != pkceChallenge(login.verifier) || q.Get("code_verifier") != "" {
+		t.Fatalf("redirect must send the S256 challenge, not the verifier: %s", authURL)
+	}
+
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	if callback.Query().Get("state") != login.state {
+		t.Fatalf("provider returned state %q", callback.Query().Get("state"))
+	}
+	return login, callback.Query().Get("code")
+}
+
+// expectLoginState makes the callback find and consume login.
+func expectLoginState(mock sqlmock.Sqlmock, login oidcLogin) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `o_id_c_login_states` WHERE state = \\?").
+		WithArgs(login.state, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "nonce", "code_verifier", "expires_at"}).
+			AddRow(login.state, login.nonce, login.verifier, time.Now().Add(time.Minute)))
+	mock.ExpectExec("DELETE FROM `o_id_c_login_states` WHERE state = \\?").
+		WithArgs(login.state).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func oidcCallback(code, state string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	OIDCCallback(c)
+	return w
+}
+
+var userColumns = []string{"id", "email", "password", "email_verified_at", "totp_enabled_at"}
+
+func TestOIDCCallbackLinksVerifiedAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	useTestKeys(t)
+	mock := mockDB(t)
+
+	login, code := startOIDCLogin(t, mock, idp)
+	expectLoginState(mock, login)
+
+	// No identity yet, so the verified account with the same email is
+	// linked. It has 2FA, so the login stops at the mfa_token.
+	now := time.Now()
+	mock.ExpectQuery("SELECT \\* FROM `user_identities`").
+		WithArgs(idp.URL, idp.Subject, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `users` WHERE email = \\?").
+		WithArgs(idp.Email, 1).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, idp.Email, "x", now, now))
+	mock.ExpectExec("INSERT INTO `user_identities`").
+		WithArgs(7, idp.URL, idp.Subject, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	w := oidcCallback(code, login.state)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"mfa_required":true`) {
+		t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCCallbackRefusesUnverifiedAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	mock := mockDB(t)
+
+	login, code := startOIDCLogin(t, mock, idp)
+	expectLoginState(mock, login)
+
+	mock.ExpectQuery("SELECT \\* FROM `user_identities`").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `users` WHERE email = \\?").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, idp.Email, "x", nil, nil))
+	mock.ExpectRollback()
+
+	w := oidcCallback(code, login.state)
+	if w.Code != 409 {
+		t.Fatalf("callback: status %d, want 409: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCCallbackRequiresProviderVerifiedEmail(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.EmailVerified = false
+	useMockIdP(t, idp)
+	mock := mockDB(t)
+
+	login, code := startOIDCLogin(t, mock, idp)
+	expectLoginState(mock, login)
+	mock.ExpectQuery("SELECT \\* FROM `user_identities`").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	w := oidcCallback(code, login.state)
+	if w.Code != 403 {
+		t.Fatalf("callback: status %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCExchangeRequiresPKCEVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	mock := mockDB(t)
+
+	login, code := startOIDCLogin(t, mock, idp)
+	if _, err := oidcProvider.Exchange(code, login.verifier+"x"); err == nil {
+		t.Fatal("exchange with the wrong code_verifier succeeded")
+	}
+
+	_, code = startOIDCLogin(t, mock, idp)
+	if _, err := oidcProvider.Exchange(code, login.verifier); err == nil {
+		t.Fatal("exchange with another login's code_verifier succeeded")
+	}
+}
+
+func TestOIDCVerifyIDTokenChecksNonce(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	mock := mockDB(t)
+
+	login, code := startOIDCLogin(t, mock, idp)
+	raw, err := oidcProvider.Exchange(code, login.verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := oidcProvider.VerifyIDToken(raw, "other-nonce"); err == nil {
+		t.Fatal("id_token with another login's nonce was accepted")
+	}
+	claims, err := oidcProvider.VerifyIDToken(raw, login.nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != idp.Subject || claims.Email != idp.Email {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `o_id_c_login_states`").
+		WillReturnRows(sqlmock.NewRows([]string{"state"}))
+	mock.ExpectRollback()
+
+	if w := oidcCallback("code", "forged"); w.Code != 400 {
+		t.Fatalf("callback: status %d, want 400", w.Code)
+	}
+}
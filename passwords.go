@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const passwordResetTTL = time.Hour
+
+var errResetTokenUsed = errors.New("reset token already used")
+
+type PasswordResetToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	User      *User     `gorm:"constraint:OnDelete:CASCADE"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func ForgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.BindJSON(&req); err != nil || req.Email == "" {
+		c.JSON(400, gin.H{"message": "email is required"})
+		return
+	}
+	req.Email = normalizeEmail(req.Email)
+
+	// Always the same answer, whether or not the account exists.
+	response := gin.H{"message": "If the account exists, a reset link has been sent"}
+
+	var user User
+	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		c.JSON(202, response)
+		return
+	}
+
+	plain, err := randomHex(32)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create reset token"})
+		return
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Only the newest link stays usable.
+		if err := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(plain),
+			ExpiresAt: now.Add(passwordResetTTL),
+		}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create reset token"})
+		return
+	}
+
+	// A failed send must look like an unknown email, so it is only logged.
+	if err := mailer.Send(passwordResetMessage(user.Email, plain)); err != nil {
+		println("⚠️ Failed to send reset email:", err.Error())
+	}
+
+	c.JSON(202, response)
+}
+
+// passwordResetMessage carries the token to send to POST /password/reset.
+// With PASSWORD_RESET_URL set to a page of the web app that does that, the
+// email links to it as well.
+func passwordResetMessage(to, token string) Message {
+	body := fmt.Sprintf("Use this token to reset your password within the next hour:\n\n%s\n", token)
+	if page := os.Getenv("PASSWORD_RESET_URL"); page != "" {
+		body += fmt.Sprintf("\nOr open this link:\n\n%s?token=%s\n", page, url.QueryEscape(token))
+	}
+	return Message{To: to, Subject: "Reset your password", Body: body}
+}
+
+func ResetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.BindJSON(&req); err != nil || req.Token == "" || req.Password == "" {
+		c.JSON(400, gin.H{"message": "token and password are required"})
+		return
+	}
+
+	var reset PasswordResetToken
+	err := db.Where("token_hash = ?", hashToken(req.Token)).First(&reset).Error
+	if err != nil || reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		c.JSON(400, gin.H{"message": "Invalid or expired reset token"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, reset.UserID).Error; err != nil {
+		c.JSON(400, gin.H{"message": "Invalid or expired reset token"})
+		return
+	}
+
+	if problems := passwordPolicy.Check(req.Password, user.Email); len(problems) > 0 {
+		respondValidation(c, ValidationErrors{"password": problems})
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to hash password"})
+		return
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errResetTokenUsed
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", reset.UserID).Updates(map[string]interface{}{
+			"password":            string(hashed),
+			"password_changed_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		// Log out everywhere: sessions and their refresh tokens are revoked
+		// here and access tokens issued before now are rejected by
+		// ValidateToken.
+		return revokeUserSessions(tx, reset.UserID)
+	})
+	if errors.Is(err, errResetTokenUsed) {
+		c.JSON(400, gin.H{"message": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Password has been reset"})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+type failingMailer struct{}
+
+func (failingMailer) Send(Message) error { return errors.New("smtp down") }
+
+func useMailer(t *testing.T, m Mailer) {
+	t.Helper()
+	previous := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = previous })
+}
+
+// expectResetToken makes ForgotPassword find user 7 and store a token,
+// whose hash ends up in hash.
+func expectResetToken(mock sqlmock.Sqlmock, hash *string) {
+	mock.ExpectQuery("SELECT \\* FROM `users` WHERE email = \\?").
+		WithArgs("ann@example.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(7, "ann@example.com"))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE `password_reset_tokens` SET `used_at`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO `password_reset_tokens`").
+		WithArgs(7, captureArg{hash}, sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestForgotPasswordEmailsToken(t *testing.T) {
+	outbox := &OutboxMailer{}
+	useMailer(t, outbox)
+	mock := mockDB(t)
+
+	var hash string
+	expectResetToken(mock, &hash)
+
+	c, w := newTestContext(0, "POST", "/password/forgot", `{"email":" Ann@Example.com "}`)
+	ForgotPassword(c)
+	if w.Code != 202 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	sent := outbox.Messages()
+	if len(sent) != 1 || sent[0].To != "ann@example.com" {
+		t.Fatalf("sent %+v", sent)
+	}
+	lines := strings.Split(sent[0].Body, "\n")
+	if len(lines) < 3 || hashToken(lines[2]) != hash {
+		t.Fatalf("email does not carry the stored token:\n%s", sent[0].Body)
+	}
+	if strings.Contains(sent[0].Body, "http") {
+		t.Fatalf("email links to a page without PASSWORD_RESET_URL:\n%s", sent[0].Body)
+	}
+}
+
+func TestForgotPasswordLinksToResetPage(t *testing.T) {
+	t.Setenv("PASSWORD_RESET_URL", "https://app.example.com/reset")
+	outbox := &OutboxMailer{}
+	useMailer(t, outbox)
+	mock := mockDB(t)
+
+	var hash string
+	expectResetToken(mock, &hash)
+
+	c, _ := newTestContext(0, "POST", "/password/forgot", `{"email":"ann@example.com"}`)
+	ForgotPassword(c)
+
+	sent := outbox.Messages()
+	if len(sent) != 1 || !strings.Contains(sent[0].Body, "https://app.example.com/reset?token=") {
+		t.Fatalf("sent %+v", sent)
+	}
+}
+
+func TestForgotPasswordAnswersAlike(t *testing.T) {
+	t.Run("unknown email", func(t *testing.T) {
+		outbox := &OutboxMailer{}
+		useMailer(t, outbox)
+		mock := mockDB(t)
+		mock.ExpectQuery("SELECT \\* FROM `users`").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		c, w := newTestContext(0, "POST", "/password/forgot", `{"email":"nobody@example.com"}`)
+		ForgotPassword(c)
+		if w.Code != 202 || len(outbox.Messages()) != 0 {
+			t.Fatalf("status %d, %d messages", w.Code, len(outbox.Messages()))
+		}
+	})
+
+	t.Run("mail failure", func(t *testing.T) {
+		useMailer(t, failingMailer{})
+		mock := mockDB(t)
+		var hash string
+		expectResetToken(mock, &hash)
+
+		c, w := newTestContext(0, "POST", "/password/forgot", `{"email":"ann@example.com"}`)
+		ForgotPassword(c)
+		if w.Code != 202 {
+			t.Fatalf("status %d, want 202: %s", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultCurrency  = "USD"
+	defaultLocale    = "en-US"
+	defaultWeekStart = "monday"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Location returns the user's time zone, or the server's when none is set.
+func (u User) Location() *time.Location {
+	if u.Timezone != "" {
+		if loc, err := time.LoadLocation(u.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+func (u User) FirstDayOfWeek() time.Weekday {
+	if day, ok := weekdays[u.WeekStart]; ok {
+		return day
+	}
+	return weekdays[defaultWeekStart]
+}
+
+// Language returns the user's locale, or the default one when it is unset
+// or no longer parses.
+func (u User) Language() language.Tag {
+	if tag, err := language.Parse(u.Locale); err == nil {
+		return tag
+	}
+	return language.MustParse(defaultLocale)
+}
+
+// ReportingCurrency is the currency amounts are converted to. It falls
+// back to the default expense currency when no base currency is set.
+func (u User) ReportingCurrency() string {
+	if u.BaseCurrency != "" {
+		return u.BaseCurrency
+	}
+	if u.Currency != "" {
+		return u.Currency
+	}
+	return defaultCurrency
+}
+
+// startOfWeek returns midnight of the most recent firstDay on or before t.
+func startOfWeek(t time.Time, firstDay time.Weekday) time.Time {
+	offset := (int(t.Weekday()) - int(firstDay) + 7) % 7
+	day := t.AddDate(0, 0, -offset)
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, t.Location())
+}
+
+var dateTimeLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+}
+
+// dateTimeFromBody reads a date or timestamp such as "spent_at" from a
+// decoded JSON body. RFC 3339 timestamps keep their offset; a date, or a
+// date and time without an offset, is read in loc. A plain date means
+// midnight.
+func dateTimeFromBody(body map[string]interface{}, key string, loc *time.Location) (time.Time, bool, error) {
+	v, ok := body[key]
+	if !ok || v == nil {
+		return time.Time{}, false, nil
+	}
+
+	invalid := errors.New(key + " must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, true, invalid
+	}
+	s = strings.TrimSpace(s)
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.In(loc), true, nil
+	}
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true, nil
+		}
+	}
+	return time.Time{}, true, invalid
+}
+
+// backfillSpentAt gives expenses recorded before spent_at existed the
+// time they were created.
+func backfillSpentAt() {
+	if err := db.Model(&Expenses{}).Where("spent_at IS NULL").Update("spent_at", gorm.Expr("created_at")).Error; err != nil {
+		panic("❌ Failed to backfill spent_at: " + err.Error())
+	}
+}
+
+// Localize shows the expense's timestamps in the user's time zone and
+// formats its amount for the user's locale.
+func (e *Expenses) Localize(user User) {
+	e.localize(user.Location(), message.NewPrinter(user.Language()))
+}
+
+func (e *Expenses) localize(loc *time.Location, p *message.Printer) {
+	e.SpentAt = e.SpentAt.In(loc)
+	e.CreatedAt = e.CreatedAt.In(loc)
+	e.UpdatedAt = e.UpdatedAt.In(loc)
+	e.FormattedAmount = formatAmount(p, e.AmountMinor, e.Currency)
+}
+
+func localizeExpenses(expenses []Expenses, user User) {
+	loc, p := user.Location(), message.NewPrinter(user.Language())
+	for i := range expenses {
+		expenses[i].localize(loc, p)
+	}
+}
+
+// formatAmount writes minor units of code the way p's locale writes money,
+// such as "€ 1.234,50" for de-DE. It is for display only; the exact value
+// stays in "amount".
+func formatAmount(p *message.Printer, minor int64, code string) string {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return FormatMinorUnits(minor, code) + " " + code
+	}
+	value := float64(minor) / math.Pow10(currencyScale(code))
+	return p.Sprint(currency.Symbol(unit.Amount(value)))
+}
+
+func profileJSON(u User) gin.H {
+	return gin.H{
+		"id":             u.ID,
+		"email":          u.Email,
+		"display_name":   u.DisplayName,
+		"currency":       u.Currency,
+		"base_currency":  u.ReportingCurrency(),
+		"timezone":       u.Location().String(),
+		"locale":         u.Locale,
+		"week_start":     u.WeekStart,
+		"email_verified": u.EmailVerifiedAt != nil,
+		"two_factor":     u.TOTPEnabledAt != nil,
+		"role":           u.Role,
+		"created_at":     u.CreatedAt,
+	}
+}
+
+func GetMe(c *gin.Context) {
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, profileJSON(user))
+}
+
+func UpdateMe(c *gin.Context) {
+	var req struct {
+		DisplayName  *string `json:"display_name"`
+		Currency     *string `json:"currency"`
+		BaseCurrency *string `json:"base_currency"`
+		Timezone     *string `json:"timezone"`
+		Locale       *string `json:"locale"`
+		WeekStart    *string `json:"week_start"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(name) > 100 {
+			c.JSON(400, gin.H{"message": "display_name must be at most 100 characters"})
+			return
+		}
+		updates["display_name"] = name
+	}
+
+	if req.Currency != nil {
+		code, err := parseCurrency(*req.Currency)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "currency must be an ISO 4217 code such as USD or EUR"})
+			return
+		}
+		updates["currency"] = code
+	}
+
+	if req.BaseCurrency != nil {
+		code, err := parseCurrency(*req.BaseCurrency)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "base_currency must be an ISO 4217 code such as USD or EUR"})
+			return
+		}
+		updates["base_currency"] = code
+	}
+
+	if req.Timezone != nil {
+		tz := strings.TrimSpace(*req.Timezone)
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+			c.JSON(400, gin.H{"message": "timezone must be an IANA time zone such as Europe/Berlin"})
+			return
+		}
+		updates["timezone"] = tz
+	}
+
+	if req.Locale != nil {
+		tag, err := language.Parse(strings.TrimSpace(*req.Locale))
+		if err != nil {
+			c.JSON(400, gin.H{"message": "locale must be a language tag such as en-US"})
+			return
+		}
+		updates["locale"] = tag.String()
+	}
+
+	if req.WeekStart != nil {
+		day := strings.ToLower(strings.TrimSpace(*req.WeekStart))
+		if _, ok := weekdays[day]; !ok {
+			c.JSON(400, gin.H{"message": "week_start must be a day name such as monday or sunday"})
+			return
+		}
+		updates["week_start"] = day
+	}
+
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(&user).Updates(updates).Error; err != nil {
+			c.JSON(500, gin.H{"message": "Failed to update profile"})
+			return
+		}
+	}
+
+	c.JSON(200, profileJSON(user))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/text/message"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		locale   string
+		minor    int64
+		currency string
+		want     string
+	}{
+		{"en-US", 123450, "EUR", "€ 1,234.50"},
+		{"de-DE", 123450, "EUR", "€ 1.234,50"},
+		{"fr-FR", 123450, "EUR", "€ 1\u00a0234,50"},
+		{"de-DE", 1234, "JPY", "¥ 1.234"},
+		{"en-US", 5, "USD", "$ 0.05"},
+		{"en-US", 1234, "BHD", "BHD 1.234"},
+	}
+	for _, tt := range tests {
+		p := message.NewPrinter(User{Locale: tt.locale}.Language())
+		if got := formatAmount(p, tt.minor, tt.currency); got != tt.want {
+			t.Errorf("formatAmount(%s, %d, %s) = %q, want %q", tt.locale, tt.minor, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestPreferenceDefaults(t *testing.T) {
+	var u User
+	if got := u.Language().String(); got != defaultLocale {
+		t.Errorf("Language() = %s, want %s", got, defaultLocale)
+	}
+	if got := u.FirstDayOfWeek(); got != time.Monday {
+		t.Errorf("FirstDayOfWeek() = %s, want Monday", got)
+	}
+}
+
+func TestUpdateMeCountsDisplayNameCharacters(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+	mock.ExpectExec("UPDATE `users` SET `display_name`").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c, w := newTestContext(1, "PATCH", "/me", `{"display_name":"`+strings.Repeat("ö", 100)+`"}`)
+	UpdateMe(c)
+	if w.Code != 200 {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestUpdateMeNormalizesBothCurrencies(t *testing.T) {
+	mock := mockDB(t)
+	expectUser(mock)
+	mock.ExpectExec("UPDATE `users` SET `base_currency`=\\?,`currency`=\\?").
+		WithArgs("JPY", "EUR", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c, w := newTestContext(1, "PATCH", "/me", `{"currency":" eur ","base_currency":"jpy"}`)
+	UpdateMe(c)
+	if w.Code != 200 {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+}
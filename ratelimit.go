@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AttemptPolicy controls lockouts: the first FreeAttempts failures in a
+// Window are free, then each further failure locks the key for twice as
+// long as the one before, starting at BaseDelay and capped at MaxDelay.
+type AttemptPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+var defaultAttemptPolicy = AttemptPolicy{
+	FreeAttempts: 5,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	Window:       15 * time.Minute,
+}
+
+func (p AttemptPolicy) lockout(failures int) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(over-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// AttemptStore tracks failed attempts per key, such as an account or a
+// client IP.
+type AttemptStore interface {
+	// Blocked returns how long key is still locked out, or zero.
+	Blocked(key string) (time.Duration, error)
+	// Fail records a failure and returns the lockout it triggers.
+	Fail(key string) (time.Duration, error)
+	// Reset forgets all failures for key.
+	Reset(key string) error
+}
+
+var attempts AttemptStore
+
+func setupAttemptStore() {
+	if os.Getenv("AUTH_ATTEMPT_STORE") == "database" {
+		attempts = &DBAttemptStore{Policy: defaultAttemptPolicy}
+		return
+	}
+	attempts = NewMemoryAttemptStore(defaultAttemptPolicy)
+}
+
+type attemptState struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// MemoryAttemptStore keeps counters in process. Each replica counts on
+// its own; use DBAttemptStore to share counters.
+type MemoryAttemptStore struct {
+	Policy AttemptPolicy
+
+	mu     sync.Mutex
+	states map[string]*attemptState
+}
+
+func NewMemoryAttemptStore(policy AttemptPolicy) *MemoryAttemptStore {
+	return &MemoryAttemptStore{Policy: policy, states: map[string]*attemptState{}}
+}
+
+func (s *MemoryAttemptStore) Blocked(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		return 0, nil
+	}
+	return max(time.Until(state.lockedUntil), 0), nil
+}
+
+func (s *MemoryAttemptStore) Fail(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	state, ok := s.states[key]
+	if !ok || now.Sub(state.lastFailure) > s.Policy.Window {
+		state = &attemptState{}
+		s.states[key] = state
+	}
+
+	state.failures++
+	state.lastFailure = now
+	wait := s.Policy.lockout(state.failures)
+	state.lockedUntil = now.Add(wait)
+
+	// Drop stale entries now and then so the map doesn't grow forever.
+	if len(s.states) > 10000 {
+		for k, st := range s.states {
+			if now.Sub(st.lastFailure) > s.Policy.Window && now.After(st.lockedUntil) {
+				delete(s.states, k)
+			}
+		}
+	}
+
+	return wait, nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, key)
+	return nil
+}
+
+type AuthAttempt struct {
+	Key           string    `gorm:"primaryKey;size:191"`
+	Failures      int       `gorm:"not null"`
+	LastFailureAt time.Time `gorm:"not null"`
+	LockedUntil   time.Time `gorm:"index;not null"`
+}
+
+// DBAttemptStore keeps counters in the database so every replica sees the
+// same lockouts.
+type DBAttemptStore struct {
+	Policy AttemptPolicy
+}
+
+func (s *DBAttemptStore) Blocked(key string) (time.Duration, error) {
+	var attempt AuthAttempt
+	err := db.Where("`key` = ?", key).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(attempt.LockedUntil), 0), nil
+}
+
+func (s *DBAttemptStore) Fail(key string) (time.Duration, error) {
+	var wait time.Duration
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var attempt AuthAttempt
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("`key` = ?", key).First(&attempt).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			attempt = AuthAttempt{Key: key}
+		} else if err != nil {
+			return err
+		}
+
+		if now.Sub(attempt.LastFailureAt) > s.Policy.Window {
+			attempt.Failures = 0
+		}
+		attempt.Failures++
+		attempt.LastFailureAt = now
+		wait = s.Policy.lockout(attempt.Failures)
+		attempt.LockedUntil = now.Add(wait)
+
+		return tx.Save(&attempt).Error
+	})
+	return wait, err
+}
+
+func (s *DBAttemptStore) Reset(key string) error {
+	return db.Where("`key` = ?", key).Delete(&AuthAttempt{}).Error
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(429, gin.H{
+		"error":       "too_many_attempts",
+		"message":     "Too many attempts, try again later",
+		"retry_after": seconds,
+	})
+}
+
+// checkAttempts aborts with 429 when key is locked out.
+func checkAttempts(c *gin.Context, key string) bool {
+	wait, err := attempts.Blocked(key)
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"message": "Database error"})
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait)
+		return false
+	}
+	return true
+}
+
+// recordFailure counts a failed attempt for key. A store error is logged
+// so a broken store doesn't silently turn lockouts off.
+func recordFailure(key string) {
+	if _, err := attempts.Fail(key); err != nil {
+		println("⚠️ Failed to record auth attempt:", err.Error())
+	}
+}
+
+func accountAttemptKey(action, account string) string {
+	return action + ":account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+// ThrottleByIP limits calls to an auth endpoint per client IP. A response
+// with a 4xx status counts as a failure; with countAll every call counts,
+// which suits endpoints like /signup where success is also costly.
+func ThrottleByIP(action string, countAll bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := action + ":ip:" + c.ClientIP()
+		if !checkAttempts(c, key) {
+			return
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if countAll || (status >= 400 && status < 500 && status != 429) {
+			recordFailure(key)
+		}
+	}
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxCatchUp caps how many missed occurrences of one template a single
+// scheduler run creates, so a template starting far in the past can't
+// stall the others.
+const maxCatchUp = 100
+
+// maxSkipAhead is how far past the next occurrence one can be skipped.
+// It bounds how long SkipRecurring walks the schedule.
+const maxSkipAhead = 5 // years
+
+// RecurrenceRule is the supported subset of an RFC 5545 RRULE:
+// FREQ=DAILY|WEEKLY|MONTHLY|YEARLY with INTERVAL, BYDAY (weekly),
+// BYMONTHDAY (monthly, -1 for the last day), COUNT and UNTIL.
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay int
+	Count      int
+	Until      *time.Time
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// ParseRecurrenceRule parses rules such as "FREQ=MONTHLY;BYMONTHDAY=1" or
+// "RRULE:FREQ=WEEKLY;INTERVAL=2". UNTIL is a date, read in loc.
+func ParseRecurrenceRule(s string, loc *time.Location) (RecurrenceRule, error) {
+	r := RecurrenceRule{Interval: 1}
+
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return r, fmt.Errorf("invalid rule part %q", part)
+		}
+
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.Freq = value
+			default:
+				return r, errors.New("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1000 {
+				return r, errors.New("INTERVAL must be a positive number")
+			}
+			r.Interval = n
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				wd, ok := rruleWeekdays[day]
+				if !ok {
+					return r, fmt.Errorf("invalid BYDAY value %q", day)
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			n, err := strconv.Atoi(value)
+			if err != nil || n == 0 || n < -1 || n > 31 {
+				return r, errors.New("BYMONTHDAY must be 1 to 31, or -1 for the last day")
+			}
+			r.ByMonthDay = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return r, errors.New("COUNT must be a positive number")
+			}
+			r.Count = n
+		case "UNTIL":
+			day, err := time.ParseInLocation("20060102", value[:min(len(value), 8)], loc)
+			if err != nil {
+				return r, errors.New("UNTIL must be a date such as 20271231")
+			}
+			end := day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			r.Until = &end
+		default:
+			return r, fmt.Errorf("%s is not supported", key)
+		}
+	}
+
+	if r.Freq == "" {
+		return r, errors.New("FREQ is required")
+	}
+	if len(r.ByDay) > 0 && r.Freq != "WEEKLY" {
+		return r, errors.New("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	if r.ByMonthDay != 0 && r.Freq != "MONTHLY" {
+		return r, errors.New("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	if r.Count > 0 && r.Until != nil {
+		return r, errors.New("COUNT and UNTIL can't be combined")
+	}
+	return r, nil
+}
+
+func daysIn(year int, month time.Month, loc *time.Location) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+}
+
+// Each calls fn with every occurrence from start, in order, until fn
+// returns false or the rule ends. Occurrences keep start's time of day.
+// Months without the requested day (the 31st, February 29) are skipped,
+// as in RFC 5545.
+func (r RecurrenceRule) Each(start time.Time, fn func(time.Time) bool) {
+	loc := start.Location()
+	h, m, sec := start.Clock()
+	at := func(y int, mo time.Month, d int) time.Time {
+		return time.Date(y, mo, d, h, m, sec, 0, loc)
+	}
+
+	n := 0
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if r.Until != nil && t.After(*r.Until) {
+			return false
+		}
+		if r.Count > 0 && n >= r.Count {
+			return false
+		}
+		n++
+		return fn(t)
+	}
+
+	// Periods without any valid day are skipped; this bounds how many in a
+	// row we look at before giving up.
+	const maxEmptyPeriods = 1000
+	empty := 0
+
+	for period := 0; empty < maxEmptyPeriods; period++ {
+		var candidates []time.Time
+		switch r.Freq {
+		case "DAILY":
+			d := start.AddDate(0, 0, period*r.Interval)
+			candidates = append(candidates, at(d.Year(), d.Month(), d.Day()))
+		case "WEEKLY":
+			if len(r.ByDay) == 0 {
+				d := start.AddDate(0, 0, 7*period*r.Interval)
+				candidates = append(candidates, at(d.Year(), d.Month(), d.Day()))
+				break
+			}
+			// Weeks start on Monday, the RRULE default.
+			weekStart := startOfWeek(start, time.Monday).AddDate(0, 0, 7*period*r.Interval)
+			for _, wd := range r.ByDay {
+				d := weekStart.AddDate(0, 0, (int(wd)-int(time.Monday)+7)%7)
+				candidates = append(candidates, at(d.Year(), d.Month(), d.Day()))
+			}
+			sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		case "MONTHLY":
+			first := time.Date(start.Year(), start.Month()+time.Month(period*r.Interval), 1, 0, 0, 0, 0, loc)
+			day := start.Day()
+			if r.ByMonthDay == -1 {
+				day = daysIn(first.Year(), first.Month(), loc)
+			} else if r.ByMonthDay > 0 {
+				day = r.ByMonthDay
+			}
+			if day <= daysIn(first.Year(), first.Month(), loc) {
+				candidates = append(candidates, at(first.Year(), first.Month(), day))
+			}
+		case "YEARLY":
+			year := start.Year() + period*r.Interval
+			if start.Day() <= daysIn(year, start.Month(), loc) {
+				candidates = append(candidates, at(year, start.Month(), start.Day()))
+			}
+		}
+
+		if len(candidates) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+		for _, t := range candidates {
+			if !emit(t) {
+				return
+			}
+		}
+	}
+}
+
+// nextOccurrence returns the first occurrence at or after from, or nil
+// when the rule has ended.
+func (r RecurrenceRule) nextOccurrence(start, from time.Time) *time.Time {
+	var next *time.Time
+	r.Each(start, func(t time.Time) bool {
+		if t.Before(from) {
+			return true
+		}
+		next = &t
+		return false
+	})
+	return next
+}
+
+// RecurringTemplate describes an expense or income that repeats. The
+// scheduler turns each occurrence into an Expenses row.
+type RecurringTemplate struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"-" gorm:"not null;index"`
+	User        *User      `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Type        string     `json:"type" gorm:"size:10;not null;default:expense"`
+	Description string     `json:"description" gorm:"not null"`
+	AmountMinor int64      `json:"amount_minor" gorm:"not null"`
+	Currency    string     `json:"currency" gorm:"size:3;not null"`
+	CategoryID  *uint      `json:"category_id"`
+	Category    *Category  `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	MerchantID  *uint      `json:"merchant_id"`
+	Merchant    *Merchant  `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	AccountID   *uint      `json:"account_id"`
+	Account     *Account   `json:"-" gorm:"constraint:OnDelete:RESTRICT"`
+	Rule        string     `json:"rule" gorm:"size:255;not null"`
+	StartsAt    time.Time  `json:"starts_at" gorm:"not null"`
+	NextRunAt   *time.Time `json:"next_run_at" gorm:"index"`
+	PausedAt    *time.Time `json:"paused_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	Tags []Tag `json:"-" gorm:"many2many:recurring_template_tags;joinForeignKey:TemplateID"`
+}
+
+// RecurringTemplateTag is the join table between templates and tags, so
+// renaming, merging or deleting a tag applies to future occurrences too.
+type RecurringTemplateTag struct {
+	TemplateID uint               `gorm:"primaryKey"`
+	Template   *RecurringTemplate `gorm:"constraint:OnDelete:CASCADE"`
+	TagID      uint               `gorm:"primaryKey;index"`
+	Tag        *Tag               `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// RecurringSkip marks one occurrence of a template that should not be
+// created.
+type RecurringSkip struct {
+	TemplateID uint               `json:"-" gorm:"primaryKey"`
+	Template   *RecurringTemplate `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Occurrence time.Time          `json:"occurrence" gorm:"primaryKey"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+func (t RecurringTemplate) rule(loc *time.Location) (RecurrenceRule, error) {
+	return ParseRecurrenceRule(t.Rule, loc)
+}
+
+// recurringTemplateJSON adds the amount, tags and the next few upcoming
+// occurrences to a template.
+func recurringTemplateJSON(t RecurringTemplate, loc *time.Location, skipped map[time.Time]bool) gin.H {
+	upcoming := []time.Time{}
+	if t.NextRunAt != nil && t.PausedAt == nil {
+		if r, err := t.rule(loc); err == nil {
+			r.Each(t.StartsAt.In(loc), func(o time.Time) bool {
+				if o.Before(t.NextRunAt.In(loc)) || skipped[o.UTC()] {
+					return true
+				}
+				upcoming = append(upcoming, o)
+				return len(upcoming) < 5
+			})
+		}
+	}
+
+	t.StartsAt = t.StartsAt.In(loc)
+	if t.NextRunAt != nil {
+		next := t.NextRunAt.In(loc)
+		t.NextRunAt = &next
+	}
+
+	tags := make([]string, 0, len(t.Tags))
+	for _, tag := range t.Tags {
+		tags = append(tags, tag.Name)
+	}
+
+	return gin.H{
+		"template": t,
+		"amount":   FormatMinorUnits(t.AmountMinor, t.Currency),
+		"tags":     tags,
+		"upcoming": upcoming,
+	}
+}
+
+func skippedOccurrences(templateID uint) (map[time.Time]bool, error) {
+	var skips []RecurringSkip
+	if err := db.Where("template_id = ?", templateID).Find(&skips).Error; err != nil {
+		return nil, err
+	}
+	out := map[time.Time]bool{}
+	for _, s := range skips {
+		out[s.Occurrence.UTC()] = true
+	}
+	return out, nil
+}
+
+// templateFromBody validates a template body with the same rules as
+// AddExpense, plus "rule" and "starts_at". It also returns the tag names.
+func templateFromBody(c *gin.Context, body map[string]interface{}, user User) (RecurringTemplate, []string, bool) {
+	loc := user.Location()
+
+	ruleText, _ := body["rule"].(string)
+	if _, err := ParseRecurrenceRule(ruleText, loc); err != nil {
+		c.JSON(400, gin.H{"message": "rule: " + err.Error()})
+		return RecurringTemplate{}, nil, false
+	}
+
+	startsAt, found, err := dateTimeFromBody(body, "starts_at", loc)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return RecurringTemplate{}, nil, false
+	}
+	if !found {
+		startsAt = time.Now().In(loc)
+	}
+
+	expense, tagNames, ok := newExpenseFromBody(c, body, user)
+	if !ok {
+		return RecurringTemplate{}, nil, false
+	}
+
+	return RecurringTemplate{
+		UserID:      user.ID,
+		Type:        expense.Type,
+		Description: expense.Description,
+		AmountMinor: expense.AmountMinor,
+		Currency:    expense.Currency,
+		CategoryID:  expense.CategoryID,
+		AccountID:   expense.AccountID,
+		Rule:        strings.ToUpper(strings.TrimSpace(ruleText)),
+		StartsAt:    startsAt,
+	}, tagNames, true
+}
+
+func CreateRecurring(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	template, tagNames, ok := templateFromBody(c, body, user)
+	if !ok {
+		return
+	}
+
+	// Occurrences from starts_at on are created, including past ones.
+	r, _ := template.rule(user.Location())
+	template.NextRunAt = r.nextOccurrence(template.StartsAt, template.StartsAt)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		merchantID, _, err := merchantFromBody(tx, body, userID, template.Description)
+		if err != nil {
+			return err
+		}
+		template.MerchantID = merchantID
+
+		tags, err := findOrCreateTags(tx, userID, tagNames)
+		if err != nil {
+			return err
+		}
+		template.Tags = tags
+		return tx.Create(&template).Error
+	})
+	if errors.Is(err, errMerchantNotFound) {
+		c.JSON(400, gin.H{"message": "merchant_id must be one of your merchants"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create recurring template"})
+		return
+	}
+
+	c.JSON(201, recurringTemplateJSON(template, user.Location(), nil))
+}
+
+func ListRecurring(c *gin.Context) {
+	userID := CurrentClaims(c).UserID
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	var templates []RecurringTemplate
+	if err := db.Where("user_id = ?", userID).Order("id").Preload("Tags").Find(&templates).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	out := make([]gin.H, 0, len(templates))
+	for _, t := range templates {
+		skipped, err := skippedOccurrences(t.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Database error"})
+			return
+		}
+		out = append(out, recurringTemplateJSON(t, user.Location(), skipped))
+	}
+
+	c.JSON(200, out)
+}
+
+// ownTemplate loads the template in :id and its owner. Other users'
+// templates are reported as not found.
+func ownTemplate(c *gin.Context) (RecurringTemplate, User, bool) {
+	var template RecurringTemplate
+	var user User
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid template ID"})
+		return template, user, false
+	}
+
+	err = db.Where("user_id = ?", CurrentClaims(c).UserID).Preload("Tags").First(&template, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"message": "Recurring template not found"})
+		return template, user, false
+	}
+	if err == nil {
+		err = db.First(&user, template.UserID).Error
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return template, user, false
+	}
+
+	return template, user, true
+}
+
+func GetRecurring(c *gin.Context) {
+	template, user, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+
+	skipped, err := skippedOccurrences(template.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, recurringTemplateJSON(template, user.Location(), skipped))
+}
+
+// UpdateRecurring replaces the template. Only occurrences from now on use
+// the new values; expenses already created are left alone.
+func UpdateRecurring(c *gin.Context) {
+	template, user, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	// Fields left out keep their current values.
+	tagNames := make([]interface{}, 0, len(template.Tags))
+	for _, tag := range template.Tags {
+		tagNames = append(tagNames, tag.Name)
+	}
+	current := map[string]interface{}{
+		"type":        template.Type,
+		"description": template.Description,
+		"amount":      FormatMinorUnits(template.AmountMinor, template.Currency),
+		"currency":    template.Currency,
+		"tags":        tagNames,
+		"rule":        template.Rule,
+		"starts_at":   template.StartsAt.In(user.Location()).Format(time.RFC3339),
+	}
+	if template.CategoryID != nil {
+		current["category_id"] = strconv.FormatUint(uint64(*template.CategoryID), 10)
+	}
+	if template.MerchantID != nil {
+		current["merchant_id"] = strconv.FormatUint(uint64(*template.MerchantID), 10)
+	}
+	if template.AccountID != nil {
+		current["account_id"] = strconv.FormatUint(uint64(*template.AccountID), 10)
+	}
+	for k, v := range body {
+		current[k] = v
+	}
+
+	updated, names, ok := templateFromBody(c, current, user)
+	if !ok {
+		return
+	}
+	updated.ID = template.ID
+	updated.PausedAt = template.PausedAt
+	updated.CreatedAt = template.CreatedAt
+
+	r, _ := updated.rule(user.Location())
+	from := time.Now()
+	if updated.StartsAt.After(from) {
+		from = updated.StartsAt
+	}
+	updated.NextRunAt = r.nextOccurrence(updated.StartsAt, from)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		merchantID, _, err := merchantFromBody(tx, current, updated.UserID, updated.Description)
+		if err != nil {
+			return err
+		}
+		updated.MerchantID = merchantID
+
+		if err := tx.Omit("Tags").Save(&updated).Error; err != nil {
+			return err
+		}
+		tags, err := findOrCreateTags(tx, updated.UserID, names)
+		if err != nil {
+			return err
+		}
+		updated.Tags = tags
+		return tx.Model(&updated).Association("Tags").Replace(tags)
+	})
+	if errors.Is(err, errMerchantNotFound) {
+		c.JSON(400, gin.H{"message": "merchant_id must be one of your merchants"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to update recurring template"})
+		return
+	}
+
+	skipped, err := skippedOccurrences(updated.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	c.JSON(200, recurringTemplateJSON(updated, user.Location(), skipped))
+}
+
+func PauseRecurring(c *gin.Context) {
+	template, user, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+
+	if template.PausedAt == nil {
+		now := time.Now()
+		template.PausedAt = &now
+		if err := db.Model(&template).Update("paused_at", now).Error; err != nil {
+			c.JSON(500, gin.H{"message": "Failed to pause recurring template"})
+			return
+		}
+	}
+
+	c.JSON(200, recurringTemplateJSON(template, user.Location(), nil))
+}
+
+// ResumeRecurring restarts a paused template. Occurrences that fell in the
+// pause are not created.
+func ResumeRecurring(c *gin.Context) {
+	template, user, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+
+	if template.PausedAt != nil {
+		r, err := template.rule(user.Location())
+		if err != nil {
+			c.JSON(500, gin.H{"message": "Invalid stored rule"})
+			return
+		}
+		template.PausedAt = nil
+		template.NextRunAt = r.nextOccurrence(template.StartsAt.In(user.Location()), time.Now())
+		if err := db.Model(&template).Select("paused_at", "next_run_at").Updates(&template).Error; err != nil {
+			c.JSON(500, gin.H{"message": "Failed to resume recurring template"})
+			return
+		}
+	}
+
+	skipped, err := skippedOccurrences(template.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	c.JSON(200, recurringTemplateJSON(template, user.Location(), skipped))
+}
+
+// SkipRecurring stops one upcoming occurrence, given as "occurrence" (a
+// date or timestamp from "upcoming"), from being created.
+func SkipRecurring(c *gin.Context) {
+	template, user, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+	loc := user.Location()
+
+	var body map[string]interface{}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	when, found, err := dateTimeFromBody(body, "occurrence", loc)
+	if err != nil || !found {
+		c.JSON(400, gin.H{"message": "occurrence must be a date (YYYY-MM-DD) or an RFC 3339 timestamp"})
+		return
+	}
+
+	if template.NextRunAt == nil {
+		c.JSON(409, gin.H{"message": "This schedule has no more occurrences"})
+		return
+	}
+	if when.After(template.NextRunAt.AddDate(maxSkipAhead, 0, 0)) {
+		c.JSON(400, gin.H{"message": "occurrence must be within " + strconv.Itoa(maxSkipAhead) + " years of the next one"})
+		return
+	}
+
+	r, err := template.rule(loc)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Invalid stored rule"})
+		return
+	}
+
+	// A plain date picks that day's occurrence.
+	var occurrence *time.Time
+	r.Each(template.StartsAt.In(loc), func(o time.Time) bool {
+		if o.Equal(when) || (when.Hour() == 0 && when.Minute() == 0 && o.Format("2006-01-02") == when.Format("2006-01-02")) {
+			occurrence = &o
+			return false
+		}
+		return !o.After(when)
+	})
+	if occurrence == nil {
+		c.JSON(400, gin.H{"message": "occurrence is not part of this schedule"})
+		return
+	}
+	if occurrence.Before(*template.NextRunAt) {
+		c.JSON(409, gin.H{"message": "This occurrence has already been created"})
+		return
+	}
+
+	skip := RecurringSkip{TemplateID: template.ID, Occurrence: *occurrence}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&skip).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to skip occurrence"})
+		return
+	}
+
+	skipped, err := skippedOccurrences(template.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	c.JSON(200, recurringTemplateJSON(template, loc, skipped))
+}
+
+// DeleteRecurring stops a template. Expenses it already created are kept.
+func DeleteRecurring(c *gin.Context) {
+	template, _, ok := ownTemplate(c)
+	if !ok {
+		return
+	}
+
+	if err := db.Delete(&template).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete recurring template"})
+		return
+	}
+
+	c.Status(204)
+}
+
+// generateRecurring creates the due occurrences of one template. The row
+// lock keeps replicas from working on the same template at once, and the
+// unique (recurring_id, occurrence) index makes a repeated insert a no-op,
+// so a crash between the insert and the next_run_at update is harmless.
+func generateRecurring(templateID uint, now time.Time) (int, error) {
+	created := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var t RecurringTemplate
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("paused_at IS NULL AND next_run_at <= ?", now).
+			Preload("User").Preload("Tags").First(&t, templateID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Done already, paused, or another replica holds it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if requireVerifiedEmail && t.User.EmailVerifiedAt == nil {
+			// Left due, so it catches up once the email is confirmed.
+			return nil
+		}
+
+		loc := t.User.Location()
+		r, err := t.rule(loc)
+		if err != nil {
+			return err
+		}
+
+		skipped := map[time.Time]bool{}
+		var skips []RecurringSkip
+		if err := tx.Where("template_id = ?", t.ID).Find(&skips).Error; err != nil {
+			return err
+		}
+		for _, s := range skips {
+			skipped[s.Occurrence.UTC()] = true
+		}
+
+		var due []time.Time
+		var next *time.Time
+		r.Each(t.StartsAt.In(loc), func(o time.Time) bool {
+			if o.Before(t.NextRunAt.In(loc)) {
+				return true
+			}
+			if o.After(now) || len(due) == maxCatchUp {
+				next = &o
+				return false
+			}
+			due = append(due, o)
+			return true
+		})
+
+		for _, o := range due {
+			if skipped[o.UTC()] {
+				continue
+			}
+
+			id := t.ID
+			occurrence := o
+			expense := Expenses{
+				UserID:      t.UserID,
+				Type:        t.Type,
+				Description: t.Description,
+				CategoryID:  t.CategoryID,
+				MerchantID:  t.MerchantID,
+				AccountID:   t.AccountID,
+				AmountMinor: t.AmountMinor,
+				Currency:    t.Currency,
+				SpentAt:     o,
+				RecurringID: &id,
+				Occurrence:  &occurrence,
+			}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&expense)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+			created++
+			if len(t.Tags) > 0 {
+				if err := tx.Model(&expense).Association("Tags").Append(t.Tags); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Model(&t).Update("next_run_at", next).Error
+	})
+	return created, err
+}
+
+// runRecurring creates every due occurrence across all templates.
+func runRecurring(now time.Time) {
+	var ids []uint
+	if err := db.Model(&RecurringTemplate{}).
+		Where("paused_at IS NULL AND next_run_at <= ?", now).
+		Pluck("id", &ids).Error; err != nil {
+		println("❌ Recurring scheduler:", err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		// Templates far behind get the rest of their catch-up next run.
+		created, err := generateRecurring(id, now)
+		if err != nil {
+			println("❌ Recurring template", id, "failed:", err.Error())
+			continue
+		}
+		if created > 0 {
+			println("✅ Recurring template", id, "created", created, "expenses")
+		}
+	}
+}
+
+// startScheduler runs the recurring expense generator in the background
+// every RECURRING_INTERVAL (default 1m). RECURRING_SCHEDULER=off turns it
+// off, for example on replicas that only serve requests.
+func startScheduler() {
+	if os.Getenv("RECURRING_SCHEDULER") == "off" {
+		println("✅ Recurring scheduler disabled")
+		return
+	}
+
+	interval := time.Minute
+	if v := os.Getenv("RECURRING_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			panic("❌ RECURRING_INTERVAL must be a duration such as 1m")
+		}
+		interval = d
+	}
+
+	go func() {
+		runRecurring(time.Now())
+		for now := range time.Tick(interval) {
+			runRecurring(now)
+		}
+	}()
+
+	println("✅ Recurring scheduler started, every", interval.String())
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// expectOwnTemplate makes ownTemplate find a template of user 1.
+func expectOwnTemplate(mock sqlmock.Sqlmock, rule string, startsAt, nextRunAt time.Time) {
+	mock.ExpectQuery("SELECT \\* FROM `recurring_templates`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "type", "description", "amount_minor", "currency", "rule", "starts_at", "next_run_at"}).
+			AddRow(9, 1, TypeExpense, "Coffee", 350, "EUR", rule, startsAt, nextRunAt))
+	mock.ExpectQuery("SELECT \\* FROM `recurring_template_tags`").
+		WillReturnRows(sqlmock.NewRows([]string{"template_id", "tag_id"}))
+	mock.ExpectQuery("SELECT \\* FROM `users`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "timezone"}).AddRow(1, "ann@example.com", "UTC"))
+}
+
+func TestSkipRecurringBoundsHowFarAhead(t *testing.T) {
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	next := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+
+	mock := mockDB(t)
+	expectOwnTemplate(mock, "FREQ=DAILY", start, next)
+
+	c, w := newTestContext(1, "POST", "/recurring/9/skip", `{"occurrence":"9999-12-31"}`)
+	c.Params = gin.Params{{Key: "id", Value: "9"}}
+
+	done := time.Now()
+	SkipRecurring(c)
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	if time.Since(done) > time.Second {
+		t.Fatalf("rejecting a far occurrence took %s", time.Since(done))
+	}
+}
+
+func TestSkipRecurringStoresOccurrence(t *testing.T) {
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	next := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+
+	mock := mockDB(t)
+	expectOwnTemplate(mock, "FREQ=DAILY", start, next)
+	mock.ExpectExec("INSERT INTO `recurring_skips`").
+		WithArgs(9, time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT \\* FROM `recurring_skips`").
+		WillReturnRows(sqlmock.NewRows([]string{"template_id", "occurrence"}).AddRow(9, time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC)))
+
+	c, w := newTestContext(1, "POST", "/recurring/9/skip", `{"occurrence":"2026-10-20"}`)
+	c.Params = gin.Params{{Key: "id", Value: "9"}}
+	SkipRecurring(c)
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	// Occurrences that were already created can't be skipped.
+	expectOwnTemplate(mock, "FREQ=DAILY", start, next)
+	c, w = newTestContext(1, "POST", "/recurring/9/skip", `{"occurrence":"2026-10-01"}`)
+	c.Params = gin.Params{{Key: "id", Value: "9"}}
+	SkipRecurring(c)
+	if w.Code != 409 {
+		t.Fatalf("status %d, want 409: %s", w.Code, w.Body)
+	}
+}
+
+func TestParseRecurrenceRule(t *testing.T) {
+	valid := []string{
+		"FREQ=DAILY",
+		"RRULE:FREQ=WEEKLY;INTERVAL=2",
+		"freq=weekly;byday=mo,we,fr",
+		"FREQ=MONTHLY;BYMONTHDAY=-1",
+		"FREQ=MONTHLY;BYMONTHDAY=31;COUNT=3",
+		"FREQ=YEARLY;UNTIL=20301231",
+		"FREQ=YEARLY;UNTIL=20301231T235959Z",
+	}
+	for _, rule := range valid {
+		if _, err := ParseRecurrenceRule(rule, time.UTC); err != nil {
+			t.Errorf("ParseRecurrenceRule(%q): %v", rule, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;INTERVAL=1001",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=MONTHLY;BYMONTHDAY=0",
+		"FREQ=MONTHLY;BYMONTHDAY=-2",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;UNTIL=2030",
+		"FREQ=DAILY;COUNT=2;UNTIL=20301231",
+		"FREQ=DAILY;BYSETPOS=1",
+		"FREQ=DAILY;COUNT",
+	}
+	for _, rule := range invalid {
+		if _, err := ParseRecurrenceRule(rule, time.UTC); err == nil {
+			t.Errorf("ParseRecurrenceRule(%q) was accepted", rule)
+		}
+	}
+}
+
+func TestParseRecurrenceRuleUntilIsInclusive(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	r, err := ParseRecurrenceRule("FREQ=DAILY;UNTIL=20301231", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2030, 12, 31, 23, 59, 59, 999999999, loc); !r.Until.Equal(want) {
+		t.Errorf("Until = %s, want %s", r.Until, want)
+	}
+}
+
+func TestRecurrenceRuleEach(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []string
+	}{
+		{
+			"daily with interval",
+			"FREQ=DAILY;INTERVAL=3",
+			time.Date(2026, 2, 27, 9, 30, 0, 0, time.UTC),
+			[]string{"2026-02-27 09:30", "2026-03-02 09:30", "2026-03-05 09:30", "2026-03-08 09:30"},
+		},
+		{
+			"last day of the month",
+			"FREQ=MONTHLY;BYMONTHDAY=-1",
+			time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC),
+			[]string{"2026-01-31 00:00", "2026-02-28 00:00", "2026-03-31 00:00", "2026-04-30 00:00"},
+		},
+		{
+			"last day in a leap year",
+			"FREQ=MONTHLY;BYMONTHDAY=-1",
+			time.Date(2028, 2, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"2028-02-29 00:00", "2028-03-31 00:00", "2028-04-30 00:00", "2028-05-31 00:00"},
+		},
+		{
+			"the 31st skips short months",
+			"FREQ=MONTHLY",
+			time.Date(2026, 1, 31, 8, 0, 0, 0, time.UTC),
+			[]string{"2026-01-31 08:00", "2026-03-31 08:00", "2026-05-31 08:00", "2026-07-31 08:00"},
+		},
+		{
+			"BYMONTHDAY before start is skipped",
+			"FREQ=MONTHLY;BYMONTHDAY=10",
+			time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC),
+			[]string{"2026-02-10 00:00", "2026-03-10 00:00", "2026-04-10 00:00", "2026-05-10 00:00"},
+		},
+		{
+			"February 29 only in leap years",
+			"FREQ=YEARLY",
+			time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+			[]string{"2024-02-29 00:00", "2028-02-29 00:00", "2032-02-29 00:00", "2036-02-29 00:00"},
+		},
+		{
+			"BYDAY in order from mid-week",
+			"FREQ=WEEKLY;BYDAY=FR,MO",
+			time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC), // a Wednesday
+			[]string{"2026-10-16 12:00", "2026-10-19 12:00", "2026-10-23 12:00", "2026-10-26 12:00"},
+		},
+		{
+			"BYDAY every other week",
+			"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO",
+			time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC),
+			[]string{"2026-10-12 00:00", "2026-10-26 00:00", "2026-11-09 00:00", "2026-11-23 00:00"},
+		},
+		{
+			"COUNT stops the rule",
+			"FREQ=WEEKLY;COUNT=2",
+			time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC),
+			[]string{"2026-10-12 00:00", "2026-10-19 00:00"},
+		},
+		{
+			"COUNT only counts occurrences from start",
+			"FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3",
+			time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			[]string{"2026-10-16 00:00", "2026-10-19 00:00", "2026-10-23 00:00"},
+		},
+		{
+			"UNTIL includes its day",
+			"FREQ=DAILY;UNTIL=20261014",
+			time.Date(2026, 10, 12, 23, 0, 0, 0, time.UTC),
+			[]string{"2026-10-12 23:00", "2026-10-13 23:00", "2026-10-14 23:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseRecurrenceRule(tt.rule, tt.start.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			r.Each(tt.start, func(at time.Time) bool {
+				got = append(got, at.Format("2006-01-02 15:04"))
+				return len(got) < 4
+			})
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("occurrences = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecurrenceRuleEachKeepsWallClockAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	r, _ := ParseRecurrenceRule("FREQ=DAILY", berlin)
+
+	var got []string
+	r.Each(time.Date(2026, 3, 28, 9, 0, 0, 0, berlin), func(at time.Time) bool {
+		got = append(got, at.Format("2006-01-02 15:04 MST"))
+		return len(got) < 3
+	})
+	want := []string{"2026-03-28 09:00 CET", "2026-03-29 09:00 CEST", "2026-03-30 09:00 CEST"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("occurrences = %v, want %v", got, want)
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	r, _ := ParseRecurrenceRule("FREQ=MONTHLY;COUNT=3", time.UTC)
+	start := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+
+	next := r.nextOccurrence(start, time.Date(2026, 2, 6, 0, 0, 0, 0, time.UTC))
+	if next == nil || !next.Equal(time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("nextOccurrence = %v, want 2026-03-05", next)
+	}
+	if next := r.nextOccurrence(start, time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)); next != nil {
+		t.Errorf("nextOccurrence after the last one = %v, want nil", next)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// lastSeenInterval limits how often a session's LastSeenAt is written.
+const lastSeenInterval = time.Minute
+
+// Session is one login on one device. Its ID is also the FamilyID of the
+// session's refresh tokens and the sid claim of its access tokens, so
+// revoking a session cuts off both at once.
+type Session struct {
+	ID         string     `json:"id" gorm:"primaryKey;size:32"`
+	UserID     uint       `json:"-" gorm:"index;not null"`
+	User       *User      `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	UserAgent  string     `json:"user_agent" gorm:"size:255"`
+	IP         string     `json:"ip" gorm:"size:45"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+func newSession(c *gin.Context, userID uint) (*Session, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	return createSession(db, c, id, userID)
+}
+
+// createSession stores a session with the given ID for the device making
+// the request.
+func createSession(tx *gorm.DB, c *gin.Context, id string, userID uint) (*Session, error) {
+	userAgent := c.Request.UserAgent()
+	if runes := []rune(userAgent); len(runes) > 255 {
+		userAgent = string(runes[:255])
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         c.ClientIP(),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL),
+	}
+	if err := tx.Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// checkSession fails with ErrTokenRevoked when the session is gone,
+// revoked or expired, and records the user as seen.
+func checkSession(sessionID string, userID uint) error {
+	var session Session
+	err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return ErrTokenRevoked
+	}
+
+	if now.Sub(session.LastSeenAt) > lastSeenInterval {
+		db.Model(&session).UpdateColumn("last_seen_at", now)
+	}
+
+	return nil
+}
+
+// revokeSession revokes a session together with its refresh tokens.
+func revokeSession(tx *gorm.DB, sessionID string) error {
+	now := time.Now()
+	if err := tx.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", now).Error
+}
+
+// revokeUserSessions logs the user out on every device.
+func revokeUserSessions(tx *gorm.DB, userID uint) error {
+	now := time.Now()
+	if err := tx.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error
+}
+
+func ListSessions(c *gin.Context) {
+	claims := CurrentClaims(c)
+
+	var sessions []Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", claims.UserID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to fetch sessions"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, gin.H{
+			"id":           s.ID,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.ID == claims.SessionID,
+		})
+	}
+
+	c.JSON(200, result)
+}
+
+func DeleteSession(c *gin.Context) {
+	var session Session
+	err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), CurrentClaims(c).UserID).
+		First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"message": "Session not found"})
+		} else {
+			c.JSON(500, gin.H{"message": "Database error"})
+		}
+		return
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return revokeSession(tx, session.ID)
+	}); err != nil {
+		c.JSON(500, gin.H{"message": "Failed to revoke session"})
+		return
+	}
+
+	c.Status(204)
+}
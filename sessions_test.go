@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateSessionTruncatesUserAgentByCharacter(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectExec("INSERT INTO `sessions`").
+		WithArgs("sid", 1, validChars(255), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c, _ := newTestContext(1, http.MethodPost, "/login", "")
+	c.Request.Header.Set("User-Agent", "M"+strings.Repeat("ö", 300))
+	if _, err := createSession(db, c, "sid", 1); err != nil {
+		t.Fatal(err)
+	}
+}
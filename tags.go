@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxTagLength = 50
+
+// Tag is a free-form label a user puts on expenses. Names are stored
+// lower-cased and are unique per user.
+type Tag struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"not null;uniqueIndex:idx_tag_user_name"`
+	User      *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Name      string    `json:"name" gorm:"size:50;not null;uniqueIndex:idx_tag_user_name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExpenseTag is the join table between expenses and tags. Rows go away
+// with either side.
+type ExpenseTag struct {
+	ExpenseID uint      `gorm:"primaryKey"`
+	Expense   *Expenses `gorm:"constraint:OnDelete:CASCADE"`
+	TagID     uint      `gorm:"primaryKey;index"`
+	Tag       *Tag      `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+var errInvalidTags = errors.New("tags must be an array of names up to 50 characters")
+
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// tagsFromBody reads the "tags" array from a decoded JSON body. The
+// names come back normalized and without duplicates.
+func tagsFromBody(body map[string]interface{}) (names []string, present bool, err error) {
+	v, ok := body["tags"]
+	if !ok {
+		return nil, false, nil
+	}
+	if v == nil {
+		return []string{}, true, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, true, errInvalidTags
+	}
+
+	seen := map[string]bool{}
+	names = []string{}
+	for _, item := range list {
+		s, ok := item.(string)
+		name := normalizeTag(s)
+		if !ok || name == "" || utf8.RuneCountInString(name) > maxTagLength {
+			return nil, true, errInvalidTags
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, true, nil
+}
+
+// findOrCreateTags returns the user's tags with the given names, creating
+// the missing ones.
+func findOrCreateTags(tx *gorm.DB, userID uint, names []string) ([]Tag, error) {
+	if len(names) == 0 {
+		return []Tag{}, nil
+	}
+
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		tags = append(tags, Tag{UserID: userID, Name: name})
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error; err != nil {
+		return nil, err
+	}
+
+	// Rows that already existed come back without an ID, so read them all.
+	var stored []Tag
+	err := tx.Where("user_id = ? AND name IN ?", userID, names).Order("name").Find(&stored).Error
+	return stored, err
+}
+
+// tagFilter narrows query to expenses carrying the tags in ?tags=a,b.
+// ?tags_match=all requires every tag; the default matches any of them.
+func tagFilter(c *gin.Context, query *gorm.DB, userID uint) (*gorm.DB, bool) {
+	param := c.Query("tags")
+	if param == "" {
+		return query, true
+	}
+
+	// Duplicates are dropped so ?tags_match=all counts each tag once.
+	seen := map[string]bool{}
+	var names []string
+	for _, name := range strings.Split(param, ",") {
+		if name = normalizeTag(name); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return query, true
+	}
+
+	tagged := db.Table("expense_tags").
+		Select("expense_tags.expense_id").
+		Joins("JOIN tags ON tags.id = expense_tags.tag_id").
+		Where("tags.user_id = ? AND tags.name IN ?", userID, names)
+
+	switch c.DefaultQuery("tags_match", "any") {
+	case "any":
+	case "all":
+		tagged = tagged.Group("expense_tags.expense_id").Having("COUNT(DISTINCT tags.id) = ?", len(names))
+	default:
+		c.JSON(400, gin.H{"message": "tags_match must be any or all"})
+		return nil, false
+	}
+
+	return query.Where("id IN (?)", tagged), true
+}
+
+func ListTags(c *gin.Context) {
+	var tags []struct {
+		ID        uint      `json:"id"`
+		Name      string    `json:"name"`
+		Expenses  int64     `json:"expenses"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	err := db.Model(&Tag{}).
+		Select("tags.id, tags.name, tags.created_at, COUNT(expense_tags.expense_id) AS expenses").
+		Joins("LEFT JOIN expense_tags ON expense_tags.tag_id = tags.id").
+		Where("tags.user_id = ?", CurrentClaims(c).UserID).
+		Group("tags.id, tags.name, tags.created_at").
+		Order("tags.name").
+		Scan(&tags).Error
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	c.JSON(200, tags)
+}
+
+// ownTag loads the tag in :id. Other users' tags are reported as not
+// found.
+func ownTag(c *gin.Context) (Tag, bool) {
+	var tag Tag
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"message": "Invalid tag ID"})
+		return tag, false
+	}
+
+	err = db.Where("user_id = ?", CurrentClaims(c).UserID).First(&tag, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"message": "Tag not found"})
+		return tag, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return tag, false
+	}
+
+	return tag, true
+}
+
+// RenameTag changes a tag's name on every expense that carries it. Use
+// merge when the new name is already taken.
+func RenameTag(c *gin.Context) {
+	tag, ok := ownTag(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	name := normalizeTag(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxTagLength {
+		c.JSON(400, gin.H{"message": "name is required and must be at most 50 characters"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&Tag{}).Where("user_id = ? AND name = ? AND id <> ?", tag.UserID, name, tag.ID).Count(&count).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+	if count > 0 {
+		c.JSON(409, gin.H{"message": "A tag with this name already exists, merge the tags instead"})
+		return
+	}
+
+	if err := db.Model(&tag).Update("name", name).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to rename tag"})
+		return
+	}
+
+	c.JSON(200, tag)
+}
+
+// MergeTag moves every expense and recurring template tagged :id over to
+// the tag named in "into", creating it if needed, and deletes :id.
+func MergeTag(c *gin.Context) {
+	source, ok := ownTag(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Into string `json:"into"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+	name := normalizeTag(req.Into)
+	if name == "" || utf8.RuneCountInString(name) > maxTagLength {
+		c.JSON(400, gin.H{"message": "into must be a tag name up to 50 characters"})
+		return
+	}
+	if name == source.Name {
+		c.JSON(400, gin.H{"message": "A tag can't be merged into itself"})
+		return
+	}
+
+	var target Tag
+	err := db.Transaction(func(tx *gorm.DB) error {
+		tags, err := findOrCreateTags(tx, source.UserID, []string{name})
+		if err != nil {
+			return err
+		}
+		target = tags[0]
+
+		if err := tx.Exec(
+			"INSERT IGNORE INTO expense_tags (expense_id, tag_id) SELECT expense_id, ? FROM expense_tags WHERE tag_id = ?",
+			target.ID, source.ID,
+		).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("tag_id = ?", source.ID).Delete(&ExpenseTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(
+			"INSERT IGNORE INTO recurring_template_tags (template_id, tag_id) SELECT template_id, ? FROM recurring_template_tags WHERE tag_id = ?",
+			target.ID, source.ID,
+		).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("tag_id = ?", source.ID).Delete(&RecurringTemplateTag{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&source).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to merge tags"})
+		return
+	}
+
+	c.JSON(200, target)
+}
+
+func DeleteTag(c *gin.Context) {
+	tag, ok := ownTag(c)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("tag_id = ?", tag.ID).Delete(&ExpenseTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("tag_id = ?", tag.ID).Delete(&RecurringTemplateTag{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&tag).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to delete tag"})
+		return
+	}
+
+	c.Status(204)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestTagFilterCountsRepeatedTagsOnce(t *testing.T) {
+	mockDB(t)
+	c, _ := newTestContext(1, http.MethodGet, "/expenses?tags=Food,food,%20FOOD%20,travel&tags_match=all", "")
+
+	query, ok := tagFilter(c, db.Model(&Expenses{}), 1)
+	if !ok {
+		t.Fatal("tagFilter rejected the request")
+	}
+	sql := query.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		var expenses []Expenses
+		return tx.Find(&expenses)
+	})
+
+	for _, want := range []string{"tags.name IN ('food','travel')", "COUNT(DISTINCT tags.id) = 2"} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("query %s\ndoes not contain %s", sql, want)
+		}
+	}
+}
+
+func TestTagsFromBodyCountsCharacters(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{strings.Repeat("食", maxTagLength), true},
+		{strings.Repeat("食", maxTagLength+1), false},
+		{strings.Repeat("a", maxTagLength), true},
+		{strings.Repeat("a", maxTagLength+1), false},
+	} {
+		_, _, err := tagsFromBody(map[string]interface{}{"tags": []interface{}{tt.name}})
+		if (err == nil) != tt.ok {
+			t.Errorf("tag of %d characters: err = %v, want ok = %v", len([]rune(tt.name)), err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RefreshToken is stored server-side as a SHA-256 hash. Every rotation
+// stays in the same family so that reuse of an old token can revoke the
+// whole chain.
+type RefreshToken struct {
+	ID           uint      `gorm:"primaryKey"`
+	UserID       uint      `gorm:"index;not null"`
+	User         *User     `gorm:"constraint:OnDelete:CASCADE"`
+	TokenHash    string    `gorm:"size:64;uniqueIndex;not null"`
+	FamilyID     string    `gorm:"size:32;index;not null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+	RevokedAt    *time.Time
+	ReplacedByID *uint
+	CreatedAt    time.Time
+}
+
+// RevokedToken records the jti of an access token that was revoked before
+// it expired. Rows can be dropped once ExpiresAt has passed.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;size:32"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken(tx *gorm.DB, userID uint, familyID string) (string, *RefreshToken, error) {
+	plain, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := &RefreshToken{
+		UserID:    userID,
+		TokenHash: hashToken(plain),
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return "", nil, err
+	}
+
+	return plain, record, nil
+}
+
+// IssueTokenPair starts a new session, and with it a new refresh token
+// family, for the user.
+func IssueTokenPair(c *gin.Context, user User) (TokenPair, error) {
+	session, err := newSession(c, user.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refresh, _, err := newRefreshToken(db, user.ID, session.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	access, err := GenerateToken(user, session.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func isTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+func RefreshTokens(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.BindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(400, gin.H{"message": "refresh_token is required"})
+		return
+	}
+
+	var stored RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&stored).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(401, gin.H{"error": "refresh_token_invalid", "message": "Invalid refresh token"})
+		} else {
+			c.JSON(500, gin.H{"message": "Database error"})
+		}
+		return
+	}
+
+	// A token that was already rotated or revoked is being replayed, so
+	// the whole family is treated as compromised.
+	if stored.RevokedAt != nil {
+		if err := revokeSession(db, stored.FamilyID); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to revoke token"})
+			return
+		}
+		c.JSON(401, gin.H{"error": "refresh_token_reused", "message": "Refresh token has already been used"})
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		c.JSON(401, gin.H{"error": "refresh_token_expired", "message": "Refresh token has expired"})
+		return
+	}
+
+	// Roles are read again so a role change shows up in the next token.
+	var user User
+	if err := db.First(&user, stored.UserID).Error; err != nil {
+		c.JSON(401, gin.H{"error": "refresh_token_invalid", "message": "Invalid refresh token"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(403, gin.H{"error": "account_disabled", "message": "Account is disabled"})
+		return
+	}
+
+	var plain string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Conditional update so two concurrent refreshes can't both win.
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", stored.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTokenRevoked
+		}
+
+		var next *RefreshToken
+		var err error
+		plain, next, err = newRefreshToken(tx, stored.UserID, stored.FamilyID)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&RefreshToken{}).Where("id = ?", stored.ID).Update("replaced_by_id", next.ID).Error; err != nil {
+			return err
+		}
+
+		// Families from before sessions existed get their session now, so
+		// the sid of the new access token names a real one.
+		var sessions int64
+		if err := tx.Model(&Session{}).Where("id = ?", stored.FamilyID).Count(&sessions).Error; err != nil {
+			return err
+		}
+		if sessions == 0 {
+			_, err := createSession(tx, c, stored.FamilyID, stored.UserID)
+			return err
+		}
+
+		now := time.Now()
+		return tx.Model(&Session{}).Where("id = ?", stored.FamilyID).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"expires_at":   next.ExpiresAt,
+		}).Error
+	})
+	if errors.Is(err, ErrTokenRevoked) {
+		if err := revokeSession(db, stored.FamilyID); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to revoke token"})
+			return
+		}
+		c.JSON(401, gin.H{"error": "refresh_token_reused", "message": "Refresh token has already been used"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to refresh token"})
+		return
+	}
+
+	access, err := GenerateToken(user, stored.FamilyID)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(200, TokenPair{
+		AccessToken:  access,
+		RefreshToken: plain,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	})
+}
+
+// Logout revokes the session of the access token used for the request
+// and, when one is supplied, the session of the given refresh token.
+func Logout(c *gin.Context) {
+	claims := CurrentClaims(c)
+	if claims.APITokenID != 0 {
+		c.JSON(400, gin.H{"message": "API tokens are revoked with DELETE /tokens/:id"})
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// The body is optional.
+	c.ShouldBindJSON(&req)
+
+	if claims.SessionID != "" {
+		if err := revokeSession(db, claims.SessionID); err != nil {
+			c.JSON(500, gin.H{"message": "Failed to revoke token"})
+			return
+		}
+	} else {
+		// Tokens issued before sessions existed are revoked by jti.
+		revoked := RevokedToken{JTI: claims.ID, ExpiresAt: claims.ExpiresAt.Time}
+		if err := db.Create(&revoked).Error; err != nil {
+			c.JSON(500, gin.H{"message": "Failed to revoke token"})
+			return
+		}
+	}
+
+	if req.RefreshToken != "" {
+		var stored RefreshToken
+		err := db.Where("token_hash = ? AND user_id = ?", hashToken(req.RefreshToken), claims.UserID).First(&stored).Error
+		if err == nil {
+			if err := revokeSession(db, stored.FamilyID); err != nil {
+				c.JSON(500, gin.H{"message": "Failed to revoke token"})
+				return
+			}
+		}
+	}
+
+	db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{})
+
+	c.Status(204)
+}
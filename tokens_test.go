@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectRotation expects RefreshTokens to find an unused token of family
+// and rotate it, up to looking up the family's session.
+func expectRotation(mock sqlmock.Sqlmock, family string, sessions int) {
+	mock.ExpectQuery("SELECT \\* FROM `refresh_tokens`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "token_hash", "family_id", "expires_at"}).
+			AddRow(7, 1, hashToken("old"), family, time.Now().Add(time.Hour)))
+	expectUser(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE `refresh_tokens` SET `revoked_at`").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO `refresh_tokens`").WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectExec("UPDATE `refresh_tokens` SET `replaced_by_id`").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM `sessions`").
+		WithArgs(family).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(sessions))
+}
+
+func TestRefreshTokensCreatesSessionForLegacyFamily(t *testing.T) {
+	useTestKeys(t)
+	mock := mockDB(t)
+	family := "0123456789abcdef0123456789abcdef"
+	expectRotation(mock, family, 0)
+	mock.ExpectExec("INSERT INTO `sessions`").
+		WithArgs(family, 1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	c, w := newTestContext(0, http.MethodPost, "/refresh", `{"refresh_token":"old"}`)
+	RefreshTokens(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var pair TokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signingKeys.Parse(pair.AccessToken, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid := token.Claims.(*Claims).SessionID; sid != family {
+		t.Errorf("sid = %q, want the family %q", sid, family)
+	}
+}
+
+func TestRefreshTokensKeepsExistingSession(t *testing.T) {
+	useTestKeys(t)
+	mock := mockDB(t)
+	family := "0123456789abcdef0123456789abcdef"
+	expectRotation(mock, family, 1)
+	mock.ExpectExec("UPDATE `sessions` SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	c, w := newTestContext(0, http.MethodPost, "/refresh", `{"refresh_token":"old"}`)
+	RefreshTokens(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestRefreshTokensReuseFailsWhenRevokeFails(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("SELECT \\* FROM `refresh_tokens`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "token_hash", "family_id", "expires_at", "revoked_at"}).
+			AddRow(7, 1, hashToken("old"), "family", time.Now().Add(time.Hour), time.Now()))
+	mock.ExpectExec("UPDATE `sessions` SET `revoked_at`").WillReturnError(errors.New("connection lost"))
+
+	c, w := newTestContext(0, http.MethodPost, "/token/refresh", `{"refresh_token":"old"}`)
+	RefreshTokens(c)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500: %s", w.Code, w.Body)
+	}
+}
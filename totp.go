@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// RFC 6238 parameters, matching what authenticator apps assume by default.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpIssuer        = "ExpenseTracker"
+	mfaTokenTTL       = 5 * time.Minute
+	mfaAudience       = "mfa"
+	recoveryCodeCount = 10
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"index;not null"`
+	User     *User  `gorm:"constraint:OnDelete:CASCADE"`
+	CodeHash string `gorm:"size:64;uniqueIndex;not null"`
+	UsedAt   *time.Time
+}
+
+type MFAClaims struct {
+	UserID uint `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching counter. Counters at or below lastCounter are refused so a code
+// can't be replayed.
+func verifyTOTP(encodedSecret, code string, now time.Time, lastCounter int64) (int64, bool) {
+	secret, err := base32NoPad.DecodeString(encodedSecret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := int64(-totpSkew); step <= totpSkew; step++ {
+		counter := current + step
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpURI(email, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// useTOTP verifies code for user and records the counter it matched.
+func useTOTP(user *User, code string) bool {
+	counter, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+	if !ok {
+		return false
+	}
+
+	// Conditional update so the same code can't be used twice in parallel.
+	result := db.Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+		Update("totp_last_counter", counter)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func useRecoveryCode(userID uint, code string) bool {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones in plain text.
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&RecoveryCode{UserID: userID, CodeHash: hashToken(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, nil
+}
+
+func IssueMFAToken(userID uint) (string, error) {
+	now := time.Now()
+	return signingKeys.Sign(MFAClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+		},
+	})
+}
+
+func EnrollTOTP(c *gin.Context) {
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		c.JSON(409, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	raw, err := randomBytes(20)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create secret"})
+		return
+	}
+	secret := base32NoPad.EncodeToString(raw)
+
+	// Stored as pending until confirmed with a valid code.
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":       secret,
+		"totp_last_counter": 0,
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Failed to save secret"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totpURI(user.Email, secret),
+	})
+}
+
+func ConfirmTOTP(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(400, gin.H{"message": "code is required"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		c.JSON(409, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(400, gin.H{"message": "Start enrollment with POST /2fa/enroll first"})
+		return
+	}
+
+	if !useTOTP(&user, req.Code) {
+		c.JSON(400, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("totp_enabled_at", time.Now()).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func DisableTOTP(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		c.JSON(400, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil ||
+		!(useTOTP(&user, req.Code) || useRecoveryCode(user.ID, req.Code)) {
+		c.JSON(401, gin.H{"message": "Invalid password or code"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled_at":   nil,
+			"totp_last_counter": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(400, gin.H{"message": "code is required"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		c.JSON(400, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !useTOTP(&user, req.Code) {
+		c.JSON(401, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to create recovery codes"})
+		return
+	}
+
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+// LoginTOTP is the second login step. It takes the mfa_token returned by
+// Login plus either a TOTP code or a recovery code.
+func LoginTOTP(c *gin.Context) {
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.MFAToken == "" {
+		c.JSON(400, gin.H{"message": "mfa_token is required"})
+		return
+	}
+
+	var claims MFAClaims
+	token, err := signingKeys.Parse(req.MFAToken, &claims, jwt.WithAudience(mfaAudience))
+	if err != nil || !token.Valid {
+		c.JSON(401, gin.H{"message": "Invalid or expired mfa_token"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || user.TOTPEnabledAt == nil {
+		c.JSON(401, gin.H{"message": "Invalid or expired mfa_token"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(403, gin.H{"message": "Account is disabled"})
+		return
+	}
+
+	// Six digits are easy to guess without a limit per account.
+	attemptKey := accountAttemptKey("login-2fa", fmt.Sprint(user.ID))
+	if !checkAttempts(c, attemptKey) {
+		return
+	}
+
+	var ok bool
+	switch {
+	case req.Code != "":
+		ok = useTOTP(&user, req.Code)
+	case req.RecoveryCode != "":
+		ok = useRecoveryCode(user.ID, req.RecoveryCode)
+	}
+	if !ok {
+		recordFailure(attemptKey)
+		c.JSON(401, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	attempts.Reset(attemptKey)
+
+	tokens, err := IssueTokenPair(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":       "Login successful",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bcrypt only looks at the first 72 bytes and GenerateFromPassword
+// rejects anything longer.
+const bcryptMaxBytes = 72
+
+// PasswordPolicy is configured with PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH
+// and PASSWORD_BLOCKLIST_FILE (one common or breached password per line).
+type PasswordPolicy struct {
+	MinLength int
+	MaxBytes  int
+	blocklist map[string]bool
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 8, MaxBytes: bcryptMaxBytes}
+
+// ValidationErrors maps a request field to everything wrong with it.
+type ValidationErrors map[string][]string
+
+func (v ValidationErrors) Add(field, message string) {
+	v[field] = append(v[field], message)
+}
+
+func respondValidation(c *gin.Context, errs ValidationErrors) {
+	c.JSON(400, gin.H{"message": "Validation failed", "errors": errs})
+}
+
+func setupPasswordPolicy() {
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic("❌ PASSWORD_MIN_LENGTH must be a positive number")
+		}
+		passwordPolicy.MinLength = n
+	}
+
+	if v := os.Getenv("PASSWORD_MAX_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < passwordPolicy.MinLength || n > bcryptMaxBytes {
+			panic("❌ PASSWORD_MAX_LENGTH must be between PASSWORD_MIN_LENGTH and 72")
+		}
+		passwordPolicy.MaxBytes = n
+	}
+
+	if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+		blocklist, err := loadBlocklist(path)
+		if err != nil {
+			panic("❌ Failed to read PASSWORD_BLOCKLIST_FILE: " + err.Error())
+		}
+		passwordPolicy.blocklist = blocklist
+		println("✅ Loaded", len(blocklist), "blocked passwords")
+	}
+}
+
+func loadBlocklist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocklist := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			blocklist[strings.ToLower(line)] = true
+		}
+	}
+	return blocklist, scanner.Err()
+}
+
+// Check returns every rule the password breaks.
+func (p PasswordPolicy) Check(password, email string) []string {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, "must be at least "+strconv.Itoa(p.MinLength)+" characters")
+	}
+	if len(password) > p.MaxBytes {
+		problems = append(problems, "must be at most "+strconv.Itoa(p.MaxBytes)+" bytes")
+	}
+	if p.blocklist[strings.ToLower(password)] {
+		problems = append(problems, "is too common, choose another")
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		problems = append(problems, "must not be your email address")
+	}
+
+	return problems
+}
+
+// normalizeEmail trims and lowercases an address so that "A@B.com " and
+// "a@b.com" are the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail expects an already normalized address.
+func validateEmail(email string) []string {
+	if email == "" {
+		return []string{"is required"}
+	}
+	if len(email) > 254 {
+		return []string{"must be at most 254 characters"}
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return []string{"is not a valid email address"}
+	}
+
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return []string{"is not a valid email address"}
+	}
+
+	return nil
+}
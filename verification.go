@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	verificationTokenTTL   = 24 * time.Hour
+	verificationResendWait = time.Minute
+	verifyEmailAudience    = "verify-email"
+)
+
+// requireVerifiedEmail blocks writes to expenses, accounts, transfers and
+// recurring expenses for unverified accounts when
+// REQUIRE_EMAIL_VERIFICATION=true.
+var requireVerifiedEmail = os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+
+type VerificationClaims struct {
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func sendVerificationEmail(user *User) error {
+	now := time.Now()
+	token, err := signingKeys.Sign(VerificationClaims{
+		UserID: user.ID,
+		Email:  user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{verifyEmailAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(verificationTokenTTL)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Open this link within 24 hours to confirm your email:\n\n%s/verify?token=%s\n",
+			appBaseURL(), url.QueryEscape(token)),
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.Model(user).Update("verification_sent_at", now).Error
+}
+
+func VerifyEmail(c *gin.Context) {
+	tokenString := c.Query("token")
+	if tokenString == "" {
+		c.JSON(400, gin.H{"message": "token is required"})
+		return
+	}
+
+	var claims VerificationClaims
+	token, err := signingKeys.Parse(tokenString, &claims, jwt.WithAudience(verifyEmailAudience))
+	if err != nil || !token.Valid {
+		c.JSON(400, gin.H{"message": "Invalid or expired verification link"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || user.Email != claims.Email {
+		c.JSON(400, gin.H{"message": "Invalid or expired verification link"})
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		if err := db.Model(&user).Update("email_verified_at", time.Now()).Error; err != nil {
+			c.JSON(500, gin.H{"message": "Failed to verify email"})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"message": "Email verified"})
+}
+
+func ResendVerification(c *gin.Context) {
+	var user User
+	if err := db.First(&user, CurrentClaims(c).UserID).Error; err != nil {
+		c.JSON(500, gin.H{"message": "Database error"})
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		c.JSON(409, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	if user.VerificationSentAt != nil {
+		if wait := time.Until(user.VerificationSentAt.Add(verificationResendWait)); wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			c.JSON(429, gin.H{"message": "Verification email was sent recently, try again later"})
+			return
+		}
+	}
+
+	if err := sendVerificationEmail(&user); err != nil {
+		c.JSON(500, gin.H{"message": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(202, gin.H{"message": "Verification email sent"})
+}
+
+// RequireVerifiedEmail rejects the request with 403 when email
+// verification is enforced and the user hasn't confirmed their address.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requireVerifiedEmail {
+			c.Next()
+			return
+		}
+
+		var user User
+		if err := db.Select("id", "email_verified_at").First(&user, CurrentClaims(c).UserID).Error; err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"message": "Database error"})
+			return
+		}
+
+		if user.EmailVerifiedAt == nil {
+			c.AbortWithStatusJSON(403, gin.H{"error": "email_unverified", "message": "Confirm your email address first"})
+			return
+		}
+
+		c.Next()
+	}
+}